@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/alranel/cino/cino-runner/runner"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Show the contents of the arduino-cli cache",
+	Long: `This command shows the location and size of the cache shared by all tests, along with the cores it contains.
+Cores and package indexes are downloaded once and reused until they are evicted.`,
+	Run: runCache,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Evict unused entries from the arduino-cli cache",
+	Long:  `This command removes the cores and the downloaded archives that were not used recently, or the whole cache if --all is given.`,
+	Run:   runCachePrune,
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cachePruneCmd.Flags().Bool("all", false, "Remove all the contents of the cache")
+	cachePruneCmd.Flags().Duration("max-age", 0, "Evict entries not used within this duration (default: cache.max_age from the config)")
+}
+
+func runCache(cmd *cobra.Command, args []string) {
+	cache := runner.DefaultCache()
+	fmt.Printf("Cache directory: %s\n", cache.Dir)
+	fmt.Printf("Size: %.1f MB\n\n", float64(cache.Size())/1024/1024)
+
+	platforms, err := cache.Platforms()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if len(platforms) == 0 {
+		fmt.Println("No cores in cache")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CORE\tVERSION\tLAST USED")
+	for _, p := range platforms {
+		lastUsed := "never"
+		if !p.LastUsed.IsZero() {
+			lastUsed = p.LastUsed.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.ID, p.Version, lastUsed)
+	}
+	w.Flush()
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) {
+	cache := runner.DefaultCache()
+
+	if all, _ := cmd.Flags().GetBool("all"); all {
+		if err := cache.Clear(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed all the contents of %s\n", cache.Dir)
+		return
+	}
+
+	maxAge, _ := cmd.Flags().GetDuration("max-age")
+	if maxAge == 0 {
+		maxAge = runner.Config.Cache.MaxAge
+	}
+	evicted, err := cache.Prune(maxAge)
+	for _, e := range evicted {
+		fmt.Printf("Evicted %s\n", e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d entries not used in the last %s evicted\n", len(evicted), maxAge)
+}
+
+// pruneCacheIfDue evicts old cache entries, at most once a day.
+func pruneCacheIfDue() {
+	cache := runner.DefaultCache()
+	if !cache.PruneIsDue() {
+		return
+	}
+	evicted, err := cache.Prune(runner.Config.Cache.MaxAge)
+	if err != nil {
+		fmt.Printf("Failed to prune cache: %s\n", err)
+	} else if len(evicted) > 0 {
+		fmt.Printf("Evicted %d unused entries from cache\n", len(evicted))
+	}
+}
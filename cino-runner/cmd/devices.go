@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alranel/cino/cino-runner/runner"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "List the connected boards",
+	Long: `This command lists the boards connected to this machine, showing whether they are already configured.
+With --write, the boards that are not configured yet are added to the devices section of the configuration file.`,
+	Run: runDevices,
+}
+
+func init() {
+	rootCmd.AddCommand(devicesCmd)
+	devicesCmd.Flags().BoolP("write", "w", false, "Add the boards that are not configured yet to the configuration file")
+}
+
+func runDevices(cmd *cobra.Command, args []string) {
+	ports, err := runner.DetectPorts(true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	var newDevices []runner.Device
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tFQBN\tVID:PID\tSERIAL NUMBER\tUSB PATH\tCONFIGURED")
+	for i, p := range ports {
+		configured := "no"
+		for j := range runner.Config.Devices {
+			if runner.Config.Devices[j].Matches(&ports[i]) {
+				configured = "yes"
+			}
+		}
+		if configured == "no" && len(p.FQBNs) == 1 {
+			d := runner.Device{FQBN: p.FQBNs[0]}
+			if p.SerialNumber != "" {
+				d.SerialNumber = p.SerialNumber
+			} else {
+				d.Port = p.Port
+			}
+			newDevices = append(newDevices, d)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Port, strings.Join(p.FQBNs, ","), p.VIDPID(),
+			p.SerialNumber, p.USBPath, configured)
+	}
+	w.Flush()
+
+	if write, _ := cmd.Flags().GetBool("write"); !write {
+		return
+	}
+	configFilePath, _ := cmd.Flags().GetString("config")
+	if configFilePath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --write requires a configuration file to be specified with --config")
+		os.Exit(1)
+	}
+	if len(newDevices) == 0 {
+		fmt.Println("No boards to add to the configuration file")
+		return
+	}
+	if err := addDevicesToConfig(configFilePath, newDevices); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("%d board(s) added to %s\n", len(newDevices), configFilePath)
+}
+
+// addDevicesToConfig appends the given devices to the devices section of the
+// configuration file, which is created if it does not exist. Comments in the
+// file are not preserved.
+func addDevicesToConfig(path string, devices []runner.Device) error {
+	var config yaml.MapSlice
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var items []yaml.MapSlice
+	for _, d := range devices {
+		item := yaml.MapSlice{{Key: "fqbn", Value: d.FQBN}}
+		if d.SerialNumber != "" {
+			item = append(item, yaml.MapItem{Key: "serial_number", Value: d.SerialNumber})
+		} else {
+			item = append(item, yaml.MapItem{Key: "port", Value: d.Port})
+		}
+		items = append(items, item)
+	}
+
+	found := false
+	for i := range config {
+		if config[i].Key == "devices" {
+			existing, _ := config[i].Value.([]interface{})
+			for _, item := range items {
+				existing = append(existing, item)
+			}
+			config[i].Value = existing
+			found = true
+		}
+	}
+	if !found {
+		config = append(config, yaml.MapItem{Key: "devices", Value: items})
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/alranel/cino/cino-runner/runner"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the runner environment",
+	Long: `This command checks that arduino-cli, the configured devices, the disk and the network are ready for running tests.
+If runner_id or db.dsn is configured, the settings for client mode and the connection to the database are checked too.`,
+	Run: runDoctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	// A database without a runner ID is a half-configured client, which
+	// checkRunnerID reports.
+	checks := runner.Doctor(runner.Config.RunnerID != "" || runner.Config.DB.DSN != "")
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAILS")
+	for _, c := range checks {
+		status := "PASS"
+		if !c.OK {
+			status = "FAIL"
+			failed++
+		} else if c.Warning {
+			status = "WARN"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, status, c.Details)
+		if c.Hint != "" {
+			fmt.Fprintf(w, "\t\t→ %s\n", c.Hint)
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("\nAll checks passed")
+}
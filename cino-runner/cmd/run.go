@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/alranel/cino/cino-runner/runner"
 	. "github.com/alranel/cino/lib"
@@ -23,6 +24,13 @@ func init() {
 func init() {
 	runCmd.Flags().StringP("fqbn", "b", "", "Fully Qualified Board Name, e.g.: arduino:avr:uno")
 	runCmd.Flags().StringP("port", "p", "", "Upload port, e.g.: COM10 or /dev/ttyACM0")
+	runCmd.Flags().StringP("monitor-port", "m", "", "Port for reading test output, if different from the upload port")
+	runCmd.Flags().StringP("programmer", "P", "", "Upload using the given programmer instead of the bootloader, e.g.: atmel_ice")
+	runCmd.Flags().Bool("native", false, "Run the tests on the host rather than on a board")
+	runCmd.Flags().String("emulator", "", "Run the tests for the given board in an emulator: simavr (AVR boards) or qemu")
+	runCmd.Flags().String("machine", "", "QEMU machine emulating the given board, e.g.: netduinoplus2")
+	runCmd.Flags().String("backend", "", "Build backend for the given board: arduino-cli (default) or platformio, in which case the board is a PlatformIO environment name")
+	runCmd.Flags().Bool("write-lock", false, "Record the versions of the cores and libraries used by each test in its cino.lock file")
 }
 
 func runRun(cmd *cobra.Command, args []string) {
@@ -35,18 +43,39 @@ func runRun(cmd *cobra.Command, args []string) {
 	{
 		board, _ := cmd.Flags().GetString("fqbn")
 		port, _ := cmd.Flags().GetString("port")
-		if board != "" || port != "" {
-			if board == "" || port == "" {
-				fmt.Fprintln(os.Stderr, "Cannot specify --board without --port and viceversa")
+		monitorPort, _ := cmd.Flags().GetString("monitor-port")
+		programmer, _ := cmd.Flags().GetString("programmer")
+		backend, _ := cmd.Flags().GetString("backend")
+		emulator, _ := cmd.Flags().GetString("emulator")
+		machine, _ := cmd.Flags().GetString("machine")
+		if native, _ := cmd.Flags().GetBool("native"); native {
+			runner.Config.Devices = []runner.Device{{Kind: runner.KindNative, FQBN: runner.NativeFQBN}}
+		} else if emulator != "" {
+			if board == "" {
+				fmt.Fprintln(os.Stderr, "Cannot specify --emulator without --board")
+				os.Exit(1)
+			}
+			runner.Config.Devices = []runner.Device{{Kind: emulator, FQBN: board, Backend: backend}}
+			runner.Config.Devices[0].Emulator.Machine = machine
+		} else if board != "" || port != "" {
+			if board == "" || (port == "" && (programmer == "" || monitorPort == "")) {
+				fmt.Fprintln(os.Stderr, "Cannot specify --board without either --port or both --programmer and --monitor-port, nor --port without --board")
 				os.Exit(1)
 			}
 
 			runner.Config.Devices = make([]runner.Device, 1)
 			runner.Config.Devices[0].FQBN = board
 			runner.Config.Devices[0].Port = port
+			runner.Config.Devices[0].MonitorPort = monitorPort
+			runner.Config.Devices[0].Backend = backend
+			if programmer != "" {
+				runner.Config.Devices[0].Upload.Method = "programmer"
+				runner.Config.Devices[0].Upload.Programmer = programmer
+			}
 		}
 	}
 
+	writeLock, _ := cmd.Flags().GetBool("write-lock")
 	success := true
 	for _, path := range args {
 		// Find tests to run
@@ -66,12 +95,26 @@ func runRun(cmd *cobra.Command, args []string) {
 		for _, test := range tests {
 			fmt.Printf("Running test in %s\n", test.RelPath())
 			devices := runner.AssignDevices(test.GetRequirements())
-			if err = runner.RunTest(&test, devices); err != nil {
+			if writeLock {
+				// The lock is being rewritten, so the versions recorded in it
+				// are ignored in favor of the latest ones.
+				test.Locked = nil
+			}
+			if err = runner.RunTest(&test, devices, nil); err != nil {
 				os.Stderr.WriteString(fmt.Sprintf("Error: %s\n", err.Error()))
 				os.Exit(1)
 			}
 
-			if test.Status == "failure" {
+			if writeLock && len(test.Versions) > 0 {
+				if err := test.WriteLock(); err != nil {
+					os.Stderr.WriteString(fmt.Sprintf("Error: %s\n", err.Error()))
+					os.Exit(1)
+				}
+				fmt.Printf("Versions written to %s\n", filepath.Join(test.RelPath(), LockFile))
+			}
+
+			// Unexpected passes fail as well, so that the xfail entry is removed
+			if test.Status == "failure" || test.Status == "xpass" {
 				success = false
 			}
 		}
@@ -34,8 +34,13 @@ func runSubscribe(cmd *cobra.Command, args []string) {
 		log.Fatal("No devices configured")
 	}
 	for _, device := range runner.Config.Devices {
-		if _, err := os.Stat(device.Port); os.IsNotExist(err) {
-			log.Fatalf("Device %s not found\n", device.Port)
+		if err := device.ResolvePort(); err != nil {
+			log.Fatal(err)
+		}
+		for _, port := range device.Ports() {
+			if _, err := os.Stat(port); os.IsNotExist(err) {
+				log.Fatalf("Device %s not found\n", port)
+			}
 		}
 	}
 
@@ -109,7 +114,11 @@ func runSubscribe(cmd *cobra.Command, args []string) {
 					fmt.Printf("  skipping test %d having other job requirements\n", i)
 					continue
 				}
-				err = runner.RunTest(&job.Tests[i], devices)
+				if !job.Tests[i].Supports(job.TestRequirements.Effective) {
+					fmt.Printf("  skipping test %d not supported by its package\n", i)
+					continue
+				}
+				err = runner.RunTest(&job.Tests[i], devices, &job)
 				if err != nil {
 					panic(err)
 				}
@@ -118,13 +127,15 @@ func runSubscribe(cmd *cobra.Command, args []string) {
 
 			// Update job
 			status := job.StatusFromResults()
-			if status == "skipped" {
+			if status == "" {
 				db.MustExec("update jobs set status = 'queued', skipped_by_runners = array_append(skipped_by_runners, $1) where id = $2",
 					runner.Config.RunnerID, job.ID)
-			} else if status == "success" || status == "failure" {
+			} else if status == "success" || status == "failure" || status == "skipped" {
 				db.MustExec("update jobs set status = $1, test_results = $2, ts_end = now() where id = $3",
 					status, job.Tests, job.ID)
 			}
 		}
+
+		pruneCacheIfDue()
 	})
 }
@@ -14,6 +14,7 @@ require (
 	go.bug.st/serial v1.1.1
 	golang.org/x/sys v0.0.0-20201223074533-0d417f636930 // indirect
 	gopkg.in/ini.v1 v1.51.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace github.com/alranel/cino/lib => ../lib
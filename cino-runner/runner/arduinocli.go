@@ -0,0 +1,436 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/alranel/cino/lib"
+	"github.com/otiai10/copy"
+	"github.com/thoas/go-funk"
+)
+
+// arduinoCLI builds sketches using arduino-cli. Cores and package indexes are
+// kept in the shared cache, while libraries are installed in a temporary user
+// directory.
+type arduinoCLI struct {
+	*buildEnv
+	cliDir        string
+	cliConfigFile string
+	cinoLibDir    string
+	sketchDir     string // sketch passed to arduino-cli, see copySketch
+	lock          *CacheLock
+	profileName   string
+	profile       *SketchProfile
+	core          string
+	coreVersion   string
+	buildDir      string
+}
+
+func (b *arduinoCLI) runCLI(args ...string) error {
+	return b.run(exec.Command("arduino-cli", args...))
+}
+
+func (b *arduinoCLI) Prepare() (err error) {
+	test, sketch, device, cache := b.test, b.test.Sketches[b.sketch], b.device, b.cache
+	if err := b.setup(); err != nil {
+		return err
+	}
+
+	// Find the sketch.yaml profile matching the device, if the sketch is
+	// to be compiled using profiles.
+	if len(sketch.Profiles) > 0 {
+		profiles, err := LoadSketchProfiles(b.sketchPath())
+		if err != nil {
+			return err
+		}
+		for _, name := range sketch.Profiles {
+			if p := profiles[name]; BoardFQBN(p.FQBN) == BoardFQBN(device.FQBN) {
+				b.profileName, b.profile = name, &p
+				break
+			}
+		}
+		if b.profile == nil {
+			return fmt.Errorf("no profile in sketch.yaml matches %s", device.FQBN)
+		}
+		b.output(fmt.Sprintf("Using profile %s\n", b.profileName))
+	}
+
+	// When testing a core, find out its identity so that we can install the
+	// tools it needs.
+	var local *localCore
+	if test.PackageType == Core {
+		if local, err = findLocalCore(cache.DataDir(), test); err != nil {
+			return err
+		}
+	}
+
+	// Install the needed core, unless it's already in the cache. Unless a
+	// version was pinned, the latest one is used. When testing a core, the
+	// released one is still installed as it provides the toolchain.
+	b.core = coreID(device.FQBN)
+	if b.profile != nil {
+		// arduino-cli installs what the profile needs by itself
+		for name, version := range b.profile.Versions() {
+			b.setVersion(name, version)
+		}
+		b.coreVersion = b.profile.Versions()[b.core]
+	} else if b.core != "" {
+		if err := b.installCore(local); err != nil {
+			return err
+		}
+	}
+
+	if err := b.installLibraries(); err != nil {
+		return err
+	}
+
+	if local != nil {
+		// Install the core that we want to test
+		if err := local.install(filepath.Join(b.cliDir, "user")); err != nil {
+			return err
+		}
+		b.output(fmt.Sprintf("Using local core %s (%s %s)\n", local.ID, local.Name, local.Version))
+	}
+
+	if err := b.copySketch(); err != nil {
+		return err
+	}
+	return b.finish()
+}
+
+// copySketch sets the sketch directory passed to arduino-cli, which requires
+// the main .ino file to be named after it. If the name doesn't match, as with
+// an application sketch at the root of a cloned repository, the sketch is
+// copied to a directory named after its main .ino file.
+func (b *arduinoCLI) copySketch() error {
+	b.sketchDir = b.sketchPath()
+	main := MainSketchFile(b.sketchDir)
+	if main == "" || filepath.Base(main) == filepath.Base(b.sketchDir)+".ino" {
+		return nil
+	}
+	dest := filepath.Join(b.cliDir, "sketch", strings.TrimSuffix(filepath.Base(main), ".ino"))
+	b.sketchDir = dest
+	return copy.Copy(b.sketchPath(), dest, copy.Options{
+		Skip: func(src string) (bool, error) {
+			return filepath.Base(src) == ".git", nil
+		},
+	})
+}
+
+// setup prepares a vanilla arduino-cli environment, updating the package
+// indexes in the cache if needed.
+func (b *arduinoCLI) setup() (err error) {
+	test, cache := b.test, b.cache
+	additionalURLs := funk.UniqString(append(append([]string{}, Config.BoardManager.AdditionalURLs...), test.AdditionalURLs...))
+
+	// Prepare a vanilla arduino-cli environment.
+	b.cliDir, err = ioutil.TempDir("/tmp", ".arduino-cli")
+	if err != nil {
+		return err
+	}
+	var cmds [][]string
+	b.cliConfigFile, cmds = cache.cliConfigCommands(b.cliDir, additionalURLs)
+	for _, cmd := range cmds {
+		if err := b.runCLI(cmd...); err != nil {
+			return err
+		}
+	}
+
+	// Keep a shared lock on the cache until upload is complete, so that
+	// the core is not evicted while we use it.
+	lock, err := cache.Lock()
+	if err != nil {
+		return err
+	}
+	b.lock = lock
+	if err := lock.Shared(); err != nil {
+		return err
+	}
+
+	// Record the additional URLs and update the package indexes if they are
+	// too old or missing. Both need exclusive access to the cache.
+	if !cache.hasURLs(additionalURLs) || cache.IndexIsStale(additionalURLs) {
+		if err := lock.Exclusive(); err != nil {
+			return err
+		}
+		if err := cache.AddURLs(additionalURLs); err != nil {
+			return err
+		}
+		if cache.IndexIsStale(additionalURLs) {
+			if err := b.runCLI("--config-file", b.cliConfigFile, "update"); err != nil {
+				if _, statErr := os.Stat(filepath.Join(cache.DataDir(), "package_index.json")); statErr != nil {
+					return err
+				}
+				b.output("Warning: failed to update package indexes, using cached ones\n")
+			}
+		}
+		if err := lock.Shared(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installLibraries installs the libraries listed in cino.yml and, when testing
+// a library, its dependencies and the library itself.
+func (b *arduinoCLI) installLibraries() (err error) {
+	test, sketch := b.test, b.test.Sketches[b.sketch]
+
+	// Install the required libraries, as declared in the cino.yml file,
+	// honoring the versions recorded in cino.lock.
+	librariesDir := filepath.Join(b.cliDir, "user/libraries")
+	os.MkdirAll(librariesDir, os.ModePerm)
+	var installedNames []string
+	installLibrary := func(spec string) error {
+		kind, location, ref := parseLibrarySpec(spec)
+		switch kind {
+		case libraryManager:
+			name, version := SplitVersion(spec)
+			if version == "" && test.Locked[name] != "" {
+				spec = name + "@" + test.Locked[name]
+			}
+			installedNames = append(installedNames, name)
+			return b.runCLI("--config-file", b.cliConfigFile, "lib", "install", spec)
+		case libraryGit:
+			b.output(fmt.Sprintf("Installing library from %s\n", spec))
+			name, err := installLibraryGit(location, ref, librariesDir)
+			installedNames = append(installedNames, name)
+			return err
+		case libraryZip:
+			if strings.Contains(location, "://") {
+				b.output(fmt.Sprintf("Downloading %s\n", location))
+				if location, err = downloadFile(location, b.cliDir); err != nil {
+					return err
+				}
+			} else if location, err = repoPath(test, location); err != nil {
+				return err
+			}
+			return b.runCLI("--config-file", b.cliConfigFile, "lib", "install", "--zip-path", location)
+		case libraryDir:
+			if location, err = repoPath(test, location); err != nil {
+				return err
+			}
+			b.output(fmt.Sprintf("Installing library from %s\n", location))
+			name, err := installLibraryDir(location, filepath.Base(location), librariesDir)
+			installedNames = append(installedNames, name)
+			return err
+		}
+		return nil
+	}
+	for _, lib := range sketch.Libraries {
+		if err := installLibrary(lib); err != nil {
+			return buildError{fmt.Sprintf("Error installing library: %s\n%s\n", lib, err.Error())}
+		}
+	}
+
+	if test.PackageType == Library {
+		// Install the dependencies of the library that we want to test,
+		// unless cino.yml overrides them or a profile is used.
+		depends, err := libraryDepends(test.PackagePath)
+		if err != nil {
+			return err
+		}
+		for _, dep := range depends {
+			if name, _ := SplitVersion(dep); b.profile != nil || funk.ContainsString(installedNames, name) {
+				continue
+			}
+			if err := installLibrary(dep); err != nil {
+				return buildError{fmt.Sprintf("Error installing dependency: %s\n%s\n", dep, err.Error())}
+			}
+		}
+
+		// Install the library that we want to test
+		/*
+			// This does not work because of arduino-cli bug: https://github.com/arduino/arduino-cli/issues/1120
+			if err := runCLI(i, "--config-file", cliConfigFile, "lib", "install", "--git-url", test.PackagePath); err != nil {
+				errs <- err
+				return
+			}
+		*/
+		if _, err := installLibraryDir(test.PackagePath, filepath.Base(test.PackagePath), librariesDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finish records the versions of the installed libraries and writes cino.h.
+func (b *arduinoCLI) finish() (err error) {
+	// Record the versions of the installed libraries
+	{
+		libs, err := installedLibraries(b.cliConfigFile)
+		if err != nil {
+			return err
+		}
+		var used []string
+		for name, version := range libs {
+			b.setVersion(name, version)
+			used = append(used, name+"@"+version)
+		}
+		sort.Strings(used)
+		if b.coreVersion != "" {
+			used = append([]string{b.core + "@" + b.coreVersion}, used...)
+		}
+		b.output(fmt.Sprintf("Using %s\n", strings.Join(used, ", ")))
+	}
+
+	// Write cino.h to a temporary file so that we can include it during compilation.
+	// This can be removed when cino is available through the Library Manager.
+	// It's kept out of the test directory, as that may be the sketch directory,
+	// whose contents determine the build key.
+	b.cinoLibDir, err = writeCinoH(b.cliDir)
+	return err
+}
+
+// installCore installs the core needed by the device, unless it's already in
+// the cache.
+func (b *arduinoCLI) installCore(local *localCore) (err error) {
+	cache, lock, core := b.cache, b.lock, b.core
+	wanted := b.test.PinnedVersion(core)
+	if wanted == "" && local != nil && local.ID == core {
+		wanted = local.ToolsVersion
+	}
+	if wanted == "" {
+		if wanted, err = latestPlatformVersion(cache.DataDir(), core); err != nil {
+			return err
+		}
+	}
+	isInstalled := func() (bool, error) {
+		installed, err := cache.InstalledPlatforms(b.cliConfigFile)
+		b.coreVersion = installed[core]
+		return b.coreVersion != "" && (wanted == "" || b.coreVersion == wanted), err
+	}
+	ok, err := isInstalled()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := lock.Exclusive(); err != nil {
+			return err
+		}
+		// Check again, as another process may have installed it meanwhile
+		if ok, err = isInstalled(); !ok && err == nil {
+			spec := core
+			if wanted != "" {
+				spec += "@" + wanted
+			}
+			if err = b.runCLI("--config-file", b.cliConfigFile, "core", "install", spec); err == nil {
+				_, err = isInstalled()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := lock.Shared(); err != nil {
+			return err
+		}
+	}
+	cache.Touch(core, b.coreVersion)
+	b.setVersion(core, b.coreVersion)
+	return nil
+}
+
+// Compile builds the sketch, unless an identical build is in the cache. As
+// builds are cached, the build ID is derived from the inputs that affect the
+// binary rather than being unique.
+func (b *arduinoCLI) Compile(flags string) (string, error) {
+	properties, err := buildProperties(flags, b.defines(), b.buildProperties())
+	if err != nil {
+		return "", err
+	}
+	sketchPath := b.sketchDir
+	key, err := buildKey(b.device.FQBN, b.coreVersion, strings.Join(properties, "\n"),
+		sketchPath, filepath.Join(b.cliDir, "user/libraries"), filepath.Join(b.cliDir, "user/hardware"))
+	if err != nil {
+		return "", err
+	}
+	buildID := "cino" + key
+	if dir, cached := b.cache.Build(key); cached {
+		b.output(fmt.Sprintf("Using cached build %s\n", key))
+		b.buildDir = dir
+		return buildID, nil
+	}
+
+	b.buildDir = filepath.Join(b.cliDir, "build")
+	args := []string{
+		"--config-file", b.cliConfigFile,
+		"compile",
+		"-b", b.device.FQBN,
+		"--libraries", b.cinoLibDir,
+		"--output-dir", b.buildDir,
+	}
+	properties[0] += " -DCINO_BUILD_ID=" + buildID
+	if b.coreVersion != "" {
+		properties[0] += " -DCINO_CORE_VERSION=" + b.coreVersion
+	}
+	for _, p := range properties {
+		args = append(args, "--build-property", p)
+	}
+	if b.profile != nil {
+		// The libraries in the user directory are ignored when using
+		// profiles, so the library under test is passed explicitly.
+		// As arduino-cli may install platforms and libraries in the
+		// cache, we need exclusive access to it.
+		args = append(args, "--profile", b.profileName, "--libraries", filepath.Join(b.cliDir, "user/libraries"))
+		if err := b.lock.Exclusive(); err != nil {
+			return "", err
+		}
+		// Check again, as another sketch may have been built meanwhile
+		if dir, cached := b.cache.Build(key); cached {
+			if err := b.lock.Shared(); err != nil {
+				return "", err
+			}
+			b.output(fmt.Sprintf("Using cached build %s\n", key))
+			b.buildDir = dir
+			return buildID, nil
+		}
+	}
+	err = b.runCLI(append(args, sketchPath)...)
+	if b.profile != nil {
+		if err := b.lock.Shared(); err != nil {
+			return "", err
+		}
+	}
+	if err != nil {
+		return "", buildError{err.Error()}
+	}
+	if dir, err := b.cache.StoreBuild(key, b.buildDir); err != nil {
+		b.output(fmt.Sprintf("Warning: failed to cache build: %s\n", err))
+	} else {
+		b.buildDir = dir
+	}
+	return buildID, nil
+}
+
+func (b *arduinoCLI) Artifacts() Artifacts {
+	artifact := filepath.Join(b.buildDir, filepath.Base(b.sketchDir)+".ino")
+	return Artifacts{
+		BuildDir: b.buildDir,
+		Bin:      artifact + ".bin",
+		Hex:      artifact + ".hex",
+		Elf:      artifact + ".elf",
+	}
+}
+
+func (b *arduinoCLI) UploadCommand() (*exec.Cmd, error) {
+	return uploadCommand(b.device, b.cliConfigFile, b.sketchDir, b.Artifacts(), b.profileName)
+}
+
+func (b *arduinoCLI) Close() {
+	if b.lock != nil {
+		b.lock.Release()
+	}
+	if b.cinoLibDir != "" {
+		os.RemoveAll(b.cinoLibDir)
+	}
+	if b.cliDir != "" {
+		os.RemoveAll(b.cliDir)
+	}
+}
@@ -0,0 +1,128 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/alranel/cino/lib"
+)
+
+// Backend builds a test sketch and uploads it to a device. A backend is
+// instantiated for each sketch of a test run, and keeps the state of its
+// build environment until closed.
+type Backend interface {
+	// Prepare sets up the build environment, installing the cores and the
+	// libraries needed by the sketch, including the package under test.
+	Prepare() error
+	// Compile builds the sketch passing the given compiler flags, and returns
+	// the build ID that the sketch will report in its hello message.
+	Compile(flags string) (buildID string, err error)
+	// Artifacts returns the paths of the files produced by Compile.
+	Artifacts() Artifacts
+	// UploadCommand returns the command uploading the built sketch to the
+	// device.
+	UploadCommand() (*exec.Cmd, error)
+	// Close removes the build environment.
+	Close()
+}
+
+// Artifacts holds the paths of the files produced by a build. Binary formats
+// not produced for a given board point to files that do not exist.
+type Artifacts struct {
+	BuildDir string
+	Bin      string
+	Hex      string
+	Elf      string
+}
+
+// buildEnv holds what a backend needs to know about the sketch it builds,
+// along with the functions for reporting its progress.
+type buildEnv struct {
+	test       *Test
+	sketch     int // index of the sketch in test.Sketches
+	device     *Device
+	cache      *Cache
+	run        func(cmd *exec.Cmd) error  // runs a command, logging it
+	output     func(s string)             // appends text to the test output
+	setVersion func(name, version string) // records the version of a core or library
+}
+
+// sketchPath returns the absolute path to the sketch.
+func (env *buildEnv) sketchPath() string {
+	return filepath.Join(env.test.Path, env.test.Sketches[env.sketch].Dir)
+}
+
+// defines returns the preprocessor symbols configured for the device and
+// the sketch.
+func (env *buildEnv) defines() []string {
+	return append(append([]string{}, env.device.Defines...), env.test.Sketches[env.sketch].Defines...)
+}
+
+// buildProperties returns the build properties configured for the device and
+// the sketch.
+func (env *buildEnv) buildProperties() []string {
+	return append(append([]string{}, env.device.BuildProperties...), env.test.Sketches[env.sketch].BuildProperties...)
+}
+
+// buildError is returned by backends when the sketch could not be built
+// because of the test itself, such as a compilation error or a missing
+// library. It makes the test fail rather than being reported as an error of
+// the runner.
+type buildError struct {
+	msg string
+}
+
+func (e buildError) Error() string {
+	return e.msg
+}
+
+// backendName returns the name of the given backend, resolving the default.
+func backendName(name string) string {
+	if name == "" {
+		return "arduino-cli"
+	}
+	return name
+}
+
+// newBackend returns the backend building the given sketch for the device.
+func newBackend(env *buildEnv) (Backend, error) {
+	if env.device.Kind == KindNative {
+		return &native{arduinoCLI: arduinoCLI{buildEnv: env}}, nil
+	}
+	switch backendName(env.device.Backend) {
+	case "arduino-cli":
+		return &arduinoCLI{buildEnv: env}, nil
+	case BackendPlatformIO:
+		return &platformIO{buildEnv: env}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", env.device.Backend)
+	}
+}
+
+// customUploadCommand returns the command configured for the device with the
+// command upload method.
+//
+// Command templates are executed by the shell and can contain the following
+// placeholders: {bin}, {hex}, {elf} (paths to the built binaries), {build_dir},
+// {port} and {fqbn}.
+func customUploadCommand(device *Device, artifacts Artifacts) (*exec.Cmd, error) {
+	if device.Upload.Command == "" {
+		return nil, fmt.Errorf("no upload command configured for device %s", device.FQBN)
+	}
+	return exec.Command("sh", "-c", expandCommand(device.Upload.Command, device, artifacts)), nil
+}
+
+// expandCommand replaces the placeholders in a command template.
+func expandCommand(command string, device *Device, artifacts Artifacts) string {
+	r := strings.NewReplacer(
+		"{bin}", shellQuote(artifacts.Bin),
+		"{hex}", shellQuote(artifacts.Hex),
+		"{elf}", shellQuote(artifacts.Elf),
+		"{build_dir}", shellQuote(artifacts.BuildDir),
+		"{port}", shellQuote(device.Port),
+		"{fqbn}", shellQuote(device.FQBN),
+	)
+	return r.Replace(command)
+}
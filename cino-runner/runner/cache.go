@@ -0,0 +1,609 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/thoas/go-funk"
+)
+
+// Cache is a directory shared by all tests and jobs, holding the package
+// indexes, the installed cores and tools and the downloaded archives used by
+// arduino-cli, along with the compiled sketches. Builds still get their own
+// isolated user directory, so that libraries installed for a test are not
+// visible to other tests.
+//
+// As the data directory of arduino-cli holds a single version of each
+// platform, cores are cached by name only: installing another version of a
+// core replaces the cached one. Libraries are installed again for each build,
+// only their downloaded archives are cached.
+//
+// Concurrent access from multiple processes is coordinated using a lock file:
+// builds hold a shared lock while using the cache, and upgrade it to an
+// exclusive one only when something needs to be installed. Goroutines of the
+// same process share the file lock (see processLock).
+type Cache struct {
+	Dir string
+}
+
+// CacheConfig holds the cache settings.
+type CacheConfig struct {
+	Dir         string
+	MaxAge      time.Duration `mapstructure:"max_age"`       // unused entries older than this are evicted
+	IndexMaxAge time.Duration `mapstructure:"index_max_age"` // package indexes older than this are updated
+}
+
+// CachedPlatform is a core installed in the cache.
+type CachedPlatform struct {
+	ID       string // such as arduino:avr
+	Version  string
+	LastUsed time.Time
+}
+
+// DefaultCache returns the cache configured for this runner.
+func DefaultCache() *Cache {
+	dir := Config.Cache.Dir
+	if dir == "" {
+		if userCacheDir, err := os.UserCacheDir(); err == nil {
+			dir = filepath.Join(userCacheDir, "cino-runner")
+		} else {
+			dir = filepath.Join(os.TempDir(), "cino-runner-cache")
+		}
+	}
+	return &Cache{Dir: dir}
+}
+
+func (c *Cache) DataDir() string      { return filepath.Join(c.Dir, "data") }
+func (c *Cache) DownloadsDir() string { return filepath.Join(c.Dir, "downloads") }
+func (c *Cache) usageDir() string     { return filepath.Join(c.Dir, "usage") }
+
+// Lock returns a new lock on the cache, which is not acquired yet.
+func (c *Cache) Lock() (*CacheLock, error) {
+	if err := os.MkdirAll(c.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	processLocksMutex.Lock()
+	defer processLocksMutex.Unlock()
+	path := filepath.Join(c.Dir, "lock")
+	p, ok := processLocks[path]
+	if !ok {
+		p = &processLock{path: path}
+		processLocks[path] = p
+	}
+	return &CacheLock{p: p}, nil
+}
+
+// processLock is the lock held by this process on a cache. A single file lock
+// is shared by all the goroutines, otherwise a goroutine upgrading its lock
+// would wait for the shared locks of the other goroutines of the same test,
+// which are only released when the test ends. Within the process, goroutines
+// are coordinated using an RWMutex: exclusive holders take it for writing,
+// while shared holders take it for reading when acquiring the lock, so that
+// they wait for any install in progress.
+type processLock struct {
+	path string
+	mu   sync.RWMutex // held for writing by the exclusive holder, if any
+
+	m    sync.Mutex // protects the fields below
+	f    *os.File
+	refs int // number of CacheLocks holding the file lock
+}
+
+var processLocks = make(map[string]*processLock)
+var processLocksMutex sync.Mutex
+
+// acquire adds a holder, taking the file lock in shared mode if it's the
+// first one.
+func (p *processLock) acquire() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.refs == 0 {
+		f, err := os.OpenFile(p.path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		if err := lockFile(f, false); err != nil {
+			f.Close()
+			return err
+		}
+		p.f = f
+	}
+	p.refs++
+	return nil
+}
+
+// release removes a holder, releasing the file lock if it was the last one.
+func (p *processLock) release() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.refs--
+	if p.refs == 0 {
+		unlockFile(p.f)
+		p.f.Close()
+		p.f = nil
+	}
+}
+
+// setMode converts the file lock to the given mode.
+func (p *processLock) setMode(exclusive bool) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return lockFile(p.f, exclusive)
+}
+
+// CacheLock is a lock on the cache, which can be held in shared or exclusive mode.
+type CacheLock struct {
+	p         *processLock
+	held      bool
+	exclusive bool
+}
+
+// Shared acquires the lock in shared mode, or downgrades an exclusive one.
+func (l *CacheLock) Shared() error {
+	if l.exclusive {
+		err := l.p.setMode(false)
+		l.exclusive = false
+		l.p.mu.Unlock()
+		return err
+	}
+	if l.held {
+		return nil
+	}
+	l.p.mu.RLock()
+	err := l.p.acquire()
+	l.p.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	l.held = true
+	return nil
+}
+
+// Exclusive acquires the lock in exclusive mode, or upgrades a shared one.
+// Note that the upgrade is not atomic, so callers must check again whatever
+// made them upgrade.
+func (l *CacheLock) Exclusive() error {
+	if l.exclusive {
+		return nil
+	}
+	if !l.held {
+		if err := l.p.acquire(); err != nil {
+			return err
+		}
+		l.held = true
+	}
+	l.p.mu.Lock()
+	if err := l.p.setMode(true); err != nil {
+		l.p.mu.Unlock()
+		return err
+	}
+	l.exclusive = true
+	return nil
+}
+
+// Release releases the lock.
+func (l *CacheLock) Release() {
+	if l.exclusive {
+		l.Shared()
+	}
+	if l.held {
+		l.p.release()
+		l.held = false
+	}
+}
+
+// IndexIsStale returns true if the package indexes, including the ones
+// downloaded from the given additional URLs, need to be updated.
+// Caller must hold a lock.
+func (c *Cache) IndexIsStale(additionalURLs []string) bool {
+	files := []string{"package_index.json"}
+	for _, u := range additionalURLs {
+		files = append(files, indexFileName(u))
+	}
+	for _, file := range files {
+		stat, err := os.Stat(filepath.Join(c.DataDir(), file))
+		if err != nil || time.Since(stat.ModTime()) > Config.Cache.IndexMaxAge {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFileName returns the name of the file where arduino-cli stores the
+// package index downloaded from the given URL.
+func indexFileName(indexURL string) string {
+	if u, err := url.Parse(indexURL); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(indexURL)
+}
+
+// AddURLs records the additional package index URLs used by a test, so that
+// the cores installed from them can be managed later. Caller must hold an
+// exclusive lock.
+func (c *Cache) AddURLs(additionalURLs []string) error {
+	known := c.urls()
+	f, err := os.OpenFile(filepath.Join(c.Dir, "additional_urls"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, u := range additionalURLs {
+		if !funk.ContainsString(known, u) {
+			if _, err := fmt.Fprintln(f, u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasURLs returns true if all the given additional URLs have already been
+// recorded. Caller must hold a lock.
+func (c *Cache) hasURLs(additionalURLs []string) bool {
+	return len(funk.SubtractString(additionalURLs, c.urls())) == 0
+}
+
+// urls returns the additional package index URLs used so far.
+func (c *Cache) urls() (out []string) {
+	data, _ := ioutil.ReadFile(filepath.Join(c.Dir, "additional_urls"))
+	for _, u := range strings.Split(string(data), "\n") {
+		if u = strings.TrimSpace(u); u != "" && !funk.ContainsString(out, u) {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// InstalledPlatforms returns the cores installed in the cache, mapped to their
+// versions. Caller must hold a lock.
+func (c *Cache) InstalledPlatforms(cliConfigFile string) (map[string]string, error) {
+	out, err := exec.Command("arduino-cli", "--config-file", cliConfigFile,
+		"core", "list", "--format", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseCoreList(out)
+}
+
+// parseCoreList parses the output of arduino-cli core list --format json.
+// Multiple versions of the format are supported.
+func parseCoreList(data []byte) (map[string]string, error) {
+	type platform struct {
+		ID               string
+		Installed        string
+		InstalledVersion string `json:"installed_version"`
+	}
+	var list []platform
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) > 0 && data[0] == '{' {
+		// arduino-cli >= 0.35 wraps the list in an object
+		var wrapper struct {
+			Platforms []platform
+		}
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return nil, err
+		}
+		list = wrapper.Platforms
+	} else if len(data) > 0 && string(data) != "null" {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]string, len(list))
+	for _, p := range list {
+		if p.InstalledVersion != "" {
+			out[p.ID] = p.InstalledVersion
+		} else {
+			out[p.ID] = p.Installed
+		}
+	}
+	return out, nil
+}
+
+// Touch records that the given core was used now, so that it is not evicted.
+func (c *Cache) Touch(id, version string) error {
+	if err := os.MkdirAll(c.usageDir(), os.ModePerm); err != nil {
+		return err
+	}
+	return touchFile(filepath.Join(c.usageDir(), usageKey(id, version)))
+}
+
+func touchFile(path string) error {
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+func usageKey(id, version string) string {
+	return strings.Replace(id, ":", "_", -1) + "@" + version
+}
+
+// Platforms lists the cores installed in the cache along with the time they
+// were last used.
+func (c *Cache) Platforms() (out []CachedPlatform, err error) {
+	err = c.withCLI(false, func(cliConfigFile string) error {
+		out, err = c.platforms(cliConfigFile)
+		return err
+	})
+	return out, err
+}
+
+func (c *Cache) platforms(cliConfigFile string) ([]CachedPlatform, error) {
+	installed, err := c.InstalledPlatforms(cliConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	var out []CachedPlatform
+	for id, version := range installed {
+		p := CachedPlatform{ID: id, Version: version}
+		if stat, err := os.Stat(filepath.Join(c.usageDir(), usageKey(id, version))); err == nil {
+			p.LastUsed = stat.ModTime()
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Size returns the disk space used by the cache, in bytes.
+func (c *Cache) Size() (size int64) {
+	filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Prune evicts the cores that were not used within maxAge, along with the
+// downloaded archives older than maxAge. It returns a description of the
+// evicted entries.
+func (c *Cache) Prune(maxAge time.Duration) (evicted []string, err error) {
+	err = c.withCLI(true, func(cliConfigFile string) error {
+		evicted, err = c.prune(cliConfigFile, maxAge)
+		return err
+	})
+	return evicted, err
+}
+
+func (c *Cache) prune(cliConfigFile string, maxAge time.Duration) (evicted []string, err error) {
+	platforms, err := c.platforms(cliConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range platforms {
+		if time.Since(p.LastUsed) <= maxAge {
+			continue
+		}
+		if out, err := exec.Command("arduino-cli", "--config-file", cliConfigFile,
+			"core", "uninstall", p.ID).CombinedOutput(); err != nil {
+			return evicted, fmt.Errorf("failed to uninstall %s: %s", p.ID, out)
+		}
+		os.Remove(filepath.Join(c.usageDir(), usageKey(p.ID, p.Version)))
+		evicted = append(evicted, fmt.Sprintf("%s@%s", p.ID, p.Version))
+	}
+
+	err = filepath.Walk(c.DownloadsDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && time.Since(info.ModTime()) > maxAge {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(c.DownloadsDir(), path)
+			evicted = append(evicted, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return evicted, err
+	}
+
+	// Platforms and libraries installed by arduino-cli for sketch.yaml profiles
+	internal, _ := ioutil.ReadDir(filepath.Join(c.DataDir(), "internal"))
+	for _, entry := range internal {
+		if entry.IsDir() && time.Since(entry.ModTime()) > maxAge {
+			if err := os.RemoveAll(filepath.Join(c.DataDir(), "internal", entry.Name())); err != nil {
+				return evicted, err
+			}
+			evicted = append(evicted, "profile dependency "+entry.Name())
+		}
+	}
+
+	builds, _ := ioutil.ReadDir(c.buildsDir())
+	for _, b := range builds {
+		if time.Since(b.ModTime()) > maxAge {
+			if err := os.RemoveAll(filepath.Join(c.buildsDir(), b.Name())); err != nil {
+				return evicted, err
+			}
+			evicted = append(evicted, "build "+b.Name())
+		}
+	}
+
+	touchFile(filepath.Join(c.Dir, "last_prune"))
+	return evicted, nil
+}
+
+// PruneIsDue returns true if the cache was not pruned in the last day.
+func (c *Cache) PruneIsDue() bool {
+	stat, err := os.Stat(filepath.Join(c.Dir, "last_prune"))
+	return err != nil || time.Since(stat.ModTime()) > 24*time.Hour
+}
+
+// Clear removes all the contents of the cache.
+func (c *Cache) Clear() error {
+	lock, err := c.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if err := lock.Exclusive(); err != nil {
+		return err
+	}
+	for _, dir := range []string{c.DataDir(), c.DownloadsDir(), c.usageDir(), c.buildsDir()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withCLI runs fn with a temporary arduino-cli configuration pointing to the
+// cache, while holding a lock on it.
+func (c *Cache) withCLI(exclusive bool, fn func(cliConfigFile string) error) error {
+	dir, err := ioutil.TempDir("", ".arduino-cli")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	cliConfigFile, err := c.writeCLIConfig(dir, c.urls())
+	if err != nil {
+		return err
+	}
+
+	lock, err := c.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if exclusive {
+		err = lock.Exclusive()
+	} else {
+		err = lock.Shared()
+	}
+	if err != nil {
+		return err
+	}
+	return fn(cliConfigFile)
+}
+
+// writeCLIConfig writes an arduino-cli configuration file in dir, using the
+// cache for data and downloads and dir itself as the user directory.
+func (c *Cache) writeCLIConfig(dir string, additionalURLs []string) (string, error) {
+	cliConfigFile, cmds := c.cliConfigCommands(dir, additionalURLs)
+	for _, args := range cmds {
+		if out, err := exec.Command("arduino-cli", args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("arduino-cli %s: %s", strings.Join(args, " "), out)
+		}
+	}
+	return cliConfigFile, nil
+}
+
+func (c *Cache) cliConfigCommands(dir string, additionalURLs []string) (string, [][]string) {
+	cliConfigFile := filepath.Join(dir, "config.yml")
+	cmds := [][]string{
+		{"config", "init", "--dest-file", cliConfigFile},
+		{"--config-file", cliConfigFile, "config", "set", "directories.data", c.DataDir()},
+		{"--config-file", cliConfigFile, "config", "set", "directories.downloads", c.DownloadsDir()},
+		{"--config-file", cliConfigFile, "config", "set", "directories.user", filepath.Join(dir, "user")},
+		{"--config-file", cliConfigFile, "config", "set", "library.enable_unsafe_install", "true"},
+	}
+	for _, u := range additionalURLs {
+		cmds = append(cmds, []string{"--config-file", cliConfigFile, "config", "add", "board_manager.additional_urls", u})
+	}
+	return cliConfigFile, cmds
+}
+
+func (c *Cache) buildsDir() string { return filepath.Join(c.Dir, "builds") }
+
+// buildKey returns the key identifying a build: a hash of all the inputs
+// that affect the compiled binary.
+func buildKey(fqbn, coreVersion, flags string, dirs ...string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "fqbn=%s\ncore=%s\nflags=%s\ncino.h=%s\n", fqbn, coreVersion, flags, cinoH)
+	for _, dir := range dirs {
+		if err := hashDir(h, dir); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// hashDir writes the paths and contents of all the files in dir to h.
+func hashDir(h hash.Hash, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), info.Size())
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+}
+
+// Build returns the directory of the cached build with the given key, if any.
+func (c *Cache) Build(key string) (string, bool) {
+	dir := filepath.Join(c.buildsDir(), key)
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return dir, true
+}
+
+// StoreBuild moves the build in dir to the cache and returns its new location.
+func (c *Cache) StoreBuild(key, dir string) (string, error) {
+	if err := os.MkdirAll(c.buildsDir(), os.ModePerm); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(c.buildsDir(), key)
+
+	// Copy to a temporary directory first, so that other processes never see
+	// an incomplete build.
+	tmp, err := ioutil.TempDir(c.buildsDir(), ".tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := copy.Copy(dir, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		// Another process stored the same build in the meantime
+		os.RemoveAll(tmp)
+		if _, ok := c.Build(key); !ok {
+			return "", err
+		}
+	}
+	return dest, nil
+}
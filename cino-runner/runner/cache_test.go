@@ -0,0 +1,453 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alranel/cino/lib"
+)
+
+func TestParseCoreList(t *testing.T) {
+	expected := map[string]string{"arduino:avr": "1.8.3", "arduino:samd": "1.8.11"}
+	tests := map[string]string{
+		"old": `[{"ID":"arduino:avr","Installed":"1.8.3"},{"ID":"arduino:samd","Installed":"1.8.11"}]`,
+		"new": `[{"id":"arduino:avr","installed":"1.8.3"},{"id":"arduino:samd","installed":"1.8.11"}]`,
+		"wrapped": `{"platforms":[{"id":"arduino:avr","installed_version":"1.8.3"},
+			{"id":"arduino:samd","installed_version":"1.8.11"}]}`,
+	}
+	for name, data := range tests {
+		got, err := parseCoreList([]byte(data))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+
+	if got, err := parseCoreList([]byte("null\n")); err != nil || len(got) != 0 {
+		t.Errorf("empty list: got %v, %v", got, err)
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sketch := filepath.Join(dir, "sketch.ino")
+	ioutil.WriteFile(sketch, []byte("void setup() {}\nvoid loop() {}\n"), 0644)
+
+	key1, _ := buildKey("arduino:avr:uno", "1.8.3", "-DFOO", dir)
+	key2, _ := buildKey("arduino:avr:uno", "1.8.3", "-DFOO", dir)
+	if key1 != key2 {
+		t.Errorf("key is not stable: %s != %s", key1, key2)
+	}
+	if key, _ := buildKey("arduino:avr:uno", "1.8.4", "-DFOO", dir); key == key1 {
+		t.Errorf("key does not depend on core version")
+	}
+	ioutil.WriteFile(sketch, []byte("void setup() {}\nvoid loop() { }\n"), 0644)
+	if key, _ := buildKey("arduino:avr:uno", "1.8.3", "-DFOO", dir); key == key1 {
+		t.Errorf("key does not depend on sources")
+	}
+
+	// In single-sketch tests the sketch directory is the test directory,
+	// so running the same test again must not change the key. The main .ino
+	// file is not named after the directory, so the sketch is also copied.
+	defer useFakeCLI(t)()
+	testDir := writeTestDir(t, map[string]string{
+		"cino.yml":   "",
+		"sketch.ino": "void setup() {}\nvoid loop() {}\n",
+	})
+	defer os.RemoveAll(testDir)
+	devices := []Device{{Kind: KindSimavr, FQBN: "arduino:avr:uno", Emulator: EmulatorConfig{
+		Command: `printf '{"plan":1}\n{"result":true,"expr":"x","file":"a.ino","line":1}\n'`,
+	}}}
+	for i := 0; i < 2; i++ {
+		tests, err := FindTests(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RunTest(&tests[0], devices, nil); err != nil {
+			t.Fatal(err)
+		}
+		if cached := strings.Contains(tests[0].Log, "Using cached build"); cached != (i == 1) {
+			t.Errorf("run %d: cached build used: %v\n%s", i+1, cached, tests[0].Log)
+		}
+	}
+}
+
+func TestCacheLockUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &Cache{Dir: dir}
+
+	// Like the sketches of a test, a goroutine upgrades its lock while
+	// another one keeps holding a shared lock.
+	held, err := cache.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := held.Shared(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		lock, err := cache.Lock()
+		if err == nil {
+			if err = lock.Shared(); err == nil {
+				if err = lock.Exclusive(); err == nil {
+					err = lock.Shared()
+				}
+			}
+			lock.Release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upgrading the lock deadlocked on the shared lock of another goroutine")
+	}
+
+	// Other processes are still excluded: a separate file lock in shared
+	// mode blocks the upgrade until it's released.
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- held.Exclusive() }()
+	select {
+	case <-done:
+		t.Fatal("exclusive lock acquired while another process holds a shared one")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlockFile(f)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	held.Release()
+	if p := held.p; p.refs != 0 || p.f != nil {
+		t.Errorf("file lock not released: %d holders", p.refs)
+	}
+}
+
+// fakeCLI is a shell script standing in for arduino-cli, implementing just
+// what is needed for installing cores and compiling. Installations take some
+// time, so that concurrent sketches overlap.
+const fakeCLI = `#!/bin/sh
+cfg=""
+if [ "$1" = "--config-file" ]; then cfg=$2; shift 2; fi
+data=$(sed -n 's/^data=//p' "$cfg" 2>/dev/null)
+case "$1" in
+config)
+	case "$2" in
+	init) : > "$4" ;;
+	set) if [ "$3" = directories.data ]; then echo "data=$4" >> "$cfg"; fi ;;
+	esac ;;
+update)
+	mkdir -p "$data"
+	sleep 0.2
+	echo '{"packages":[{"name":"arduino","platforms":[{"architecture":"avr","version":"1.8.6"},{"architecture":"samd","version":"1.8.13"}]}]}' > "$data/package_index.json"
+	echo update >> "$data/log" ;;
+core)
+	case "$2" in
+	list)
+		printf '['
+		sep=''
+		if [ -f "$data/installed" ]; then
+			while read id version; do
+				printf '%s{"id":"%s","installed":"%s"}' "$sep" "$id" "$version"
+				sep=','
+			done < "$data/installed"
+		fi
+		printf ']' ;;
+	install)
+		sleep 0.2
+		# Like arduino-cli, keep a single version of each platform
+		if [ -f "$data/installed" ]; then
+			grep -v "^${3%@*} " "$data/installed" > "$data/installed.new"
+			mv "$data/installed.new" "$data/installed"
+		fi
+		echo "$3" | tr '@' ' ' >> "$data/installed"
+		echo "install $3" >> "$data/log" ;;
+	esac ;;
+lib) echo '[]' ;;
+compile)
+	out=""
+	while [ $# -gt 1 ]; do
+		if [ "$1" = --output-dir ]; then out=$2; fi
+		if [ "$1" = --profile ]; then echo "profile $2" >> "$data/log"; fi
+		shift
+	done
+	if [ ! -f "$1/$(basename "$1").ino" ]; then
+		echo "main file missing from sketch" >&2
+		exit 1
+	fi
+	sleep 0.2
+	mkdir -p "$out"
+	touch "$out/$(basename "$1").ino.elf" ;;
+esac
+`
+
+// useFakeCLI puts the fake arduino-cli in the PATH and configures an empty
+// cache. The returned function restores the previous settings.
+func useFakeCLI(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cino-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binDir := filepath.Join(dir, "bin")
+	os.Mkdir(binDir, os.ModePerm)
+	if err := ioutil.WriteFile(filepath.Join(binDir, "arduino-cli"), []byte(fakeCLI), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	path, cacheConfig := os.Getenv("PATH"), Config.Cache
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+path)
+	Config.Cache = CacheConfig{Dir: filepath.Join(dir, "cache"), IndexMaxAge: time.Hour}
+	return func() {
+		os.Setenv("PATH", path)
+		Config.Cache = cacheConfig
+		os.RemoveAll(dir)
+	}
+}
+
+// runWithFakeCLI runs the given multi-sketch test with the fake arduino-cli
+// and an empty cache, on emulated devices whose output is the given one. It
+// returns the log of the cache operations.
+func runWithFakeCLI(t *testing.T, testDir string, fqbns []string, output string) string {
+	defer useFakeCLI(t)()
+
+	tests, err := FindTests(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []Device
+	for _, fqbn := range fqbns {
+		devices = append(devices, Device{Kind: KindSimavr, FQBN: fqbn,
+			Emulator: EmulatorConfig{Command: "printf '" + output + "'"}})
+	}
+	done := make(chan error)
+	go func() { done <- RunTest(&tests[0], devices, nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatal("test deadlocked")
+	}
+	if tests[0].Status != "success" {
+		t.Errorf("Test failed:\n%s", tests[0].Log)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(DefaultCache().DataDir(), "log"))
+	return string(data)
+}
+
+// writeTestDir writes a test made of the given files.
+func writeTestDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRunTestSharedCache(t *testing.T) {
+	// Two sketches for different cores with a cold cache: each one upgrades
+	// its lock for updating the indexes and installing its core while the
+	// other one holds a shared lock.
+	dir := writeTestDir(t, map[string]string{
+		"cino.yml": "sketches:\n  - dir: a\n  - dir: b\n",
+		"a/a.ino":  "void setup() {}\nvoid loop() {}\n",
+		"b/b.ino":  "void setup() {}\nvoid loop() {}\n",
+	})
+	defer os.RemoveAll(dir)
+	log := runWithFakeCLI(t, dir, []string{"arduino:avr:uno", "arduino:samd:mkr1000"},
+		`{"plan":1}\n{"result":true,"expr":"x","file":"a.ino","line":1}\n`)
+	if n := strings.Count(log, "update\n"); n != 1 {
+		t.Errorf("indexes updated %d times instead of once:\n%s", n, log)
+	}
+	for _, core := range []string{"arduino:avr@1.8.6", "arduino:samd@1.8.13"} {
+		if strings.Count(log, "install "+core+"\n") != 1 {
+			t.Errorf("%s not installed exactly once:\n%s", core, log)
+		}
+	}
+}
+
+func TestRunTestSharedCacheProfiles(t *testing.T) {
+	// The same sketch built twice with a profile: compiling requires an
+	// exclusive lock, and the second build must be taken from the cache.
+	dir := writeTestDir(t, map[string]string{
+		"cino.yml":      "sketches:\n  - dir: a\n    profiles: [uno]\n  - dir: a\n    profiles: [uno]\n",
+		"a/a.ino":       "void setup() {}\nvoid loop() {}\n",
+		"a/sketch.yaml": "profiles:\n  uno:\n    fqbn: arduino:avr:uno\n    platforms:\n      - platform: arduino:avr (1.8.6)\n",
+	})
+	defer os.RemoveAll(dir)
+	log := runWithFakeCLI(t, dir, []string{"arduino:avr:uno", "arduino:avr:uno"},
+		`{"plan":1}\n{"result":true,"expr":"x","file":"a.ino","line":1}\n`)
+	if n := strings.Count(log, "profile uno\n"); n != 1 {
+		t.Errorf("sketch compiled %d times instead of once:\n%s", n, log)
+	}
+}
+
+func TestCacheCoreVersions(t *testing.T) {
+	// Only one version of each core is kept in the cache, so tests pinning
+	// different versions replace each other's.
+	defer useFakeCLI(t)()
+	devices := []Device{{Kind: KindSimavr, FQBN: "arduino:avr:uno", Emulator: EmulatorConfig{
+		Command: `printf '{"plan":1}\n{"result":true,"expr":"x","file":"a.ino","line":1}\n'`,
+	}}}
+	for _, version := range []string{"1.8.5", "1.8.6", "1.8.5", "1.8.5"} {
+		dir := writeTestDir(t, map[string]string{
+			"cino.yml":   "cores:\n  - arduino:avr@" + version + "\n",
+			"sketch.ino": "void setup() {}\nvoid loop() {}\n",
+		})
+		defer os.RemoveAll(dir)
+		tests, err := FindTests(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RunTest(&tests[0], devices, nil); err != nil {
+			t.Fatal(err)
+		}
+		if v := tests[0].Versions["arduino:avr"]; v != version {
+			t.Errorf("used arduino:avr@%s instead of %s", v, version)
+		}
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(DefaultCache().DataDir(), "log"))
+	var installs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "install ") {
+			installs = append(installs, strings.TrimPrefix(line, "install "))
+		}
+	}
+	expected := []string{"arduino:avr@1.8.5", "arduino:avr@1.8.6", "arduino:avr@1.8.5"}
+	if !reflect.DeepEqual(installs, expected) {
+		t.Errorf("got installs %v, expected %v", installs, expected)
+	}
+}
+
+func TestIndexIsStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &Cache{Dir: dir}
+	maxAge := Config.Cache.IndexMaxAge
+	defer func() { Config.Cache.IndexMaxAge = maxAge }()
+	Config.Cache.IndexMaxAge = time.Hour
+	os.MkdirAll(cache.DataDir(), os.ModePerm)
+	urls := []string{"https://example.com/boards/package_foo_index.json?token=1"}
+
+	if !cache.IndexIsStale(nil) {
+		t.Errorf("missing index not stale")
+	}
+	ioutil.WriteFile(filepath.Join(cache.DataDir(), "package_index.json"), []byte("{}"), 0644)
+	if cache.IndexIsStale(nil) {
+		t.Errorf("fresh index stale")
+	}
+	if !cache.IndexIsStale(urls) {
+		t.Errorf("missing additional index not stale")
+	}
+	ioutil.WriteFile(filepath.Join(cache.DataDir(), "package_foo_index.json"), []byte("{}"), 0644)
+	if cache.IndexIsStale(urls) {
+		t.Errorf("fresh additional index stale")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(cache.DataDir(), "package_foo_index.json"), old, old)
+	if !cache.IndexIsStale(urls) || cache.IndexIsStale(nil) {
+		t.Errorf("old additional index not stale")
+	}
+}
+
+func TestIndexFileName(t *testing.T) {
+	for u, expected := range map[string]string{
+		"https://downloads.arduino.cc/packages/package_index.json":                                          "package_index.json",
+		"https://github.com/earlephilhower/arduino-pico/releases/download/global/package_rp2040_index.json": "package_rp2040_index.json",
+		"https://example.com/package_foo_index.json?token=1#x":                                              "package_foo_index.json",
+	} {
+		if got := indexFileName(u); got != expected {
+			t.Errorf("%s: got %s, expected %s", u, got, expected)
+		}
+	}
+}
+
+func TestAddURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &Cache{Dir: dir}
+
+	if !cache.hasURLs(nil) || cache.hasURLs([]string{"https://a/index.json"}) {
+		t.Errorf("wrong result with no recorded URLs")
+	}
+	if err := cache.AddURLs([]string{"https://a/index.json", "https://b/index.json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddURLs([]string{"https://b/index.json", "https://c/index.json"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://a/index.json", "https://b/index.json", "https://c/index.json"}
+	if got := cache.urls(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "additional_urls"))
+	if strings.Count(string(data), "https://b/index.json") != 1 {
+		t.Errorf("URL recorded twice:\n%s", data)
+	}
+	if !cache.hasURLs([]string{"https://c/index.json", "https://a/index.json"}) || cache.hasURLs([]string{"https://d/index.json"}) {
+		t.Errorf("wrong result with recorded URLs")
+	}
+}
+
+func TestCLIConfigCommands(t *testing.T) {
+	cache := &Cache{Dir: "/cache"}
+	file, cmds := cache.cliConfigCommands("/tmp/cli", []string{"https://a/index.json", "https://b/index.json"})
+	if file != filepath.Join("/tmp/cli", "config.yml") {
+		t.Errorf("wrong config file %s", file)
+	}
+	var urls []string
+	for _, cmd := range cmds {
+		if len(cmd) == 6 && cmd[0] == "--config-file" && cmd[1] == file && cmd[2] == "config" &&
+			cmd[3] == "add" && cmd[4] == "board_manager.additional_urls" {
+			urls = append(urls, cmd[5])
+		}
+	}
+	if expected := []string{"https://a/index.json", "https://b/index.json"}; !reflect.DeepEqual(urls, expected) {
+		t.Errorf("got additional URLs %v, expected %v", urls, expected)
+	}
+	expected := []string{"--config-file", file, "config", "set", "directories.data", cache.DataDir()}
+	if !reflect.DeepEqual(cmds[1], expected) {
+		t.Errorf("got %q, expected %q", cmds[1], expected)
+	}
+	if _, cmds := cache.cliConfigCommands("/tmp/cli", nil); strings.Contains(fmt.Sprint(cmds), "additional_urls") {
+		t.Errorf("additional URLs configured without any")
+	}
+}
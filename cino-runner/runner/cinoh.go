@@ -0,0 +1,210 @@
+// Code generated by gen_cinoh.go; DO NOT EDIT.
+
+package runner
+
+// ProtocolVersion is the version of the protocol spoken by cino.h.
+const ProtocolVersion = 1
+
+// cinoH is the content of cino-library/src/cino.h.
+const cinoH = `#ifndef CINO_H
+#define CINO_H
+
+#include <stdarg.h>
+#include <stdio.h>
+
+#define _quote(x) #x
+#define _cino_xquote(x) _quote(x)
+
+// Version of the protocol spoken with cino-runner. It must be increased
+// whenever the format of the messages printed to the serial port changes.
+#define CINO_PROTOCOL_VERSION 1
+
+#ifdef CINO_TEST
+
+#ifndef CINO_SERIAL
+#define CINO_SERIAL Serial
+#endif
+
+#ifndef CINO_BAUD_RATE
+#define CINO_BAUD_RATE 9600
+#endif
+
+#ifdef CINO_SERIAL_CONFIG
+#define _cino_serial_begin() CINO_SERIAL.begin(CINO_BAUD_RATE, CINO_SERIAL_CONFIG)
+#else
+#define _cino_serial_begin() CINO_SERIAL.begin(CINO_BAUD_RATE)
+#endif
+
+#ifdef CINO_NATIVE
+// Sketches built for running on the host exit instead of hanging, so that
+// cino-runner does not have to wait for them.
+#include <stdlib.h>
+#define _cino_halt() exit(0)
+#else
+#define _cino_halt() \
+    while (1)        \
+    {                \
+    }
+#endif
+
+#define TEST_PLAN(n)                 \
+    _cino_begin();                   \
+    CINO_SERIAL.print("{\"plan\":"); \
+    CINO_SERIAL.print(n);            \
+    CINO_SERIAL.println("}")
+
+#define TEST_NOPLAN() TEST_PLAN(-1)
+
+#define TEST_DONE()                             \
+    do                                          \
+    {                                           \
+        _cino_begin();                          \
+        CINO_SERIAL.println("{\"done\":true}"); \
+    } while (0)
+
+#define SKIP(reason)                       \
+    do                                     \
+    {                                      \
+        _cino_begin();                     \
+        CINO_SERIAL.print("{\"skip\":");   \
+        CINO_SERIAL.print(_quote(reason)); \
+        CINO_SERIAL.println("}");          \
+        _cino_halt();                      \
+    } while (0)
+
+// _cino_hello prints the protocol version along with the information about
+// the build that cino-runner passes as compile-time defines, if any.
+void _cino_hello()
+{
+    CINO_SERIAL.print("{\"version\":");
+    CINO_SERIAL.print(CINO_PROTOCOL_VERSION);
+#ifdef CINO_FQBN
+    CINO_SERIAL.print(",\"fqbn\":\"");
+    CINO_SERIAL.print(_cino_xquote(CINO_FQBN));
+    CINO_SERIAL.print("\"");
+#endif
+#ifdef CINO_CORE_VERSION
+    CINO_SERIAL.print(",\"core\":\"");
+    CINO_SERIAL.print(_cino_xquote(CINO_CORE_VERSION));
+    CINO_SERIAL.print("\"");
+#endif
+#ifdef CINO_BUILD_ID
+    CINO_SERIAL.print(",\"build\":\"");
+    CINO_SERIAL.print(_cino_xquote(CINO_BUILD_ID));
+    CINO_SERIAL.print("\"");
+#endif
+    CINO_SERIAL.println("}");
+}
+
+// _cino_begin opens the serial port and prints the hello message. It is called
+// by TEST_PLAN() and, for sketches that do not declare a plan, by the first
+// assertion or log message.
+void _cino_begin()
+{
+    static bool started = false;
+    if (started)
+        return;
+    started = true;
+    _cino_serial_begin();
+    while (!CINO_SERIAL)
+    {
+    }
+    _cino_hello();
+}
+
+void _cino_check(bool result, char *quoted_expr, char *file, int line, bool fatal)
+{
+    _cino_begin();
+    CINO_SERIAL.print("{\"result\":");
+    CINO_SERIAL.print(result ? "true" : "false");
+    CINO_SERIAL.print(",\"expr\":");
+    CINO_SERIAL.print(quoted_expr);
+    CINO_SERIAL.print(",\"file\":\"");
+    String f(file);
+    f.replace("\"", "");
+    CINO_SERIAL.print(f.substring(f.lastIndexOf('/') + 1));
+    CINO_SERIAL.print("\",\"line\":");
+    CINO_SERIAL.print(line);
+    if (!result)
+    {
+        CINO_SERIAL.print(",\"fatal\":");
+        CINO_SERIAL.print(fatal ? "true" : "false");
+    }
+    CINO_SERIAL.println("}");
+    if (fatal && !result)
+        _cino_halt();
+}
+
+void _cino_log(const char *fmt, ...)
+{
+    char msg[128];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+    _cino_begin();
+    CINO_SERIAL.print("{\"log\":\"");
+    for (char *c = msg; *c; c++)
+    {
+        if (*c == '"' || *c == '\\')
+            CINO_SERIAL.print('\\');
+        CINO_SERIAL.print(*c < ' ' ? ' ' : *c);
+    }
+    CINO_SERIAL.println("\"}");
+}
+
+void _cino_log(const String &msg)
+{
+    _cino_log("%s", msg.c_str());
+}
+
+#ifdef CINO_COMPACT
+// In compact mode no strings are stored for assertions: each one is identified
+// by a hash of its file name, computed at compile time, and its line number.
+// cino-runner scans the sketch sources to map them back to expressions.
+constexpr uint16_t _cino_hash(const char *s, uint16_t h)
+{
+    return *s == 0 ? h : (*s == '/' || *s == '\\') ? _cino_hash(s + 1, 5381) : _cino_hash(s + 1, (h * 33) ^ *s);
+}
+
+template <uint16_t N>
+struct _cino_const
+{
+    static const uint16_t value = N;
+};
+
+void _cino_check_compact(bool result, uint16_t file, int line, bool fatal)
+{
+    _cino_begin();
+    CINO_SERIAL.print('#');
+    CINO_SERIAL.print(file, HEX);
+    CINO_SERIAL.print(':');
+    CINO_SERIAL.print(line);
+    CINO_SERIAL.print(':');
+    CINO_SERIAL.println(result ? 1 : (fatal ? 2 : 0));
+    if (fatal && !result)
+        _cino_halt();
+}
+
+#define REQUIRE(expr) _cino_check_compact((expr), _cino_const<_cino_hash(__FILE__, 5381)>::value, __LINE__, 1)
+#define CHECK(expr) _cino_check_compact((expr), _cino_const<_cino_hash(__FILE__, 5381)>::value, __LINE__, 0)
+#else
+#define REQUIRE(expr) _cino_check((expr), _quote(#expr), __FILE__, __LINE__, 1)
+#define CHECK(expr) _cino_check((expr), _quote(#expr), __FILE__, __LINE__, 0)
+#endif
+#define TEST_LOG(...) _cino_log(__VA_ARGS__)
+
+#else
+// cino-runner defines CINO_TEST when compiling. Otherwise, as when a sketch
+// with embedded assertions is compiled for production, everything is a no-op
+// and the asserted expressions are not evaluated.
+#define TEST_PLAN(n) ((void)0)
+#define TEST_NOPLAN() ((void)0)
+#define TEST_DONE() ((void)0)
+#define SKIP(reason) ((void)0)
+#define REQUIRE(expr) ((void)0)
+#define CHECK(expr) ((void)0)
+#define TEST_LOG(...) ((void)0)
+#endif
+
+#endif`
@@ -0,0 +1,40 @@
+package runner
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestCinoHUpToDate(t *testing.T) {
+	cinoh, err := ioutil.ReadFile("../../cino-library/src/cino.h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cinoh) != cinoH {
+		t.Error("cinoh.go is out of date with cino-library/src/cino.h; run go generate")
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	msg := testMsg{Version: ProtocolVersion, FQBN: "arduino:samd:mkr1000", Core: "1.8.13", Build: "cino1"}
+	if err := checkHello(&msg, "arduino:samd:mkr1000:opt=val", "1.8.13", "cino1"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := checkHello(&msg, "arduino:samd:mkr1000", "1.8.13", "cino2"); err == nil {
+		t.Error("Stale build not detected")
+	}
+	if err := checkHello(&msg, "arduino:avr:uno", "1.8.13", "cino1"); err == nil {
+		t.Error("FQBN mismatch not detected")
+	}
+	if err := checkHello(&msg, "arduino:samd:mkr1000", "1.8.12", "cino1"); err == nil {
+		t.Error("Core version mismatch not detected")
+	}
+	msg.Core = ""
+	if err := checkHello(&msg, "arduino:samd:mkr1000", "1.8.12", "cino1"); err != nil {
+		t.Errorf("Unexpected error without core version: %s", err)
+	}
+	msg.Version = ProtocolVersion + 1
+	if err := checkHello(&msg, "arduino:samd:mkr1000", "1.8.13", "cino1"); err == nil {
+		t.Error("Protocol version mismatch not detected")
+	}
+}
@@ -0,0 +1,174 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// In compact mode, cino.h does not print the expression and the file name of
+// each assertion: this saves a lot of RAM on small boards. A record like
+//
+//	#1a2b:42:1
+//
+// is printed instead, containing a hash of the source file name (in hex), the
+// line number and the result (1 = pass, 0 = fail, 2 = fatal failure).
+// The runner scans the sketch sources to build a table that maps such records
+// back to the assertions.
+
+// assertion is an entry of the table used to decode compact records.
+type assertion struct {
+	Expr string
+	File string
+	Line int
+}
+
+type assertionKey struct {
+	fileHash uint16
+	line     int
+}
+
+type assertionTable map[assertionKey]assertion
+
+var assertionRe = regexp.MustCompile(`\b(REQUIRE|CHECK)\s*\(`)
+
+// compactFileHash computes the same hash that cino.h computes at compile time
+// on __FILE__. Only the base name of the file is considered.
+func compactFileHash(path string) uint16 {
+	h := uint16(5381)
+	for _, c := range []byte(path) {
+		if c == '/' || c == '\\' {
+			h = 5381
+		} else {
+			h = h*33 ^ uint16(c)
+		}
+	}
+	return h
+}
+
+// scanAssertions builds the table of the assertions contained in the sources
+// of the given sketch, including those in its src subdirectory, which
+// arduino-cli compiles recursively.
+func scanAssertions(sketchPath string) (assertionTable, error) {
+	table := make(assertionTable)
+	scan := func(file string) error {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sketchPath, file)
+		if err != nil {
+			return err
+		}
+		scanSource(table, filepath.ToSlash(rel), string(src))
+		return nil
+	}
+	for _, pattern := range sourcePatterns {
+		files, err := filepath.Glob(filepath.Join(sketchPath, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := scan(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := filepath.Walk(filepath.Join(sketchPath, "src"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() || !isSourceFile(path) {
+			return err
+		}
+		return scan(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// sourcePatterns match the sketch sources that may contain assertions.
+var sourcePatterns = []string{"*.ino", "*.cpp", "*.h", "*.hpp"}
+
+func isSourceFile(path string) bool {
+	for _, pattern := range sourcePatterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func scanSource(table assertionTable, file string, src string) {
+	hash := compactFileHash(file)
+	for _, m := range assertionRe.FindAllStringIndex(src, -1) {
+		// Find the closing parenthesis
+		depth := 0
+		end := -1
+		for i := m[1] - 1; i < len(src) && end == -1; i++ {
+			switch src[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end == -1 {
+			continue
+		}
+		expr := strings.Join(strings.Fields(src[m[1]:end]), " ")
+
+		// The compiler may report either line of a multi-line assertion,
+		// so we register all of them.
+		first := strings.Count(src[:m[0]], "\n") + 1
+		last := first + strings.Count(src[m[0]:end], "\n")
+		for line := first; line <= last; line++ {
+			key := assertionKey{hash, line}
+			if a, ok := table[key]; ok {
+				a.Expr += " / " + expr
+				table[key] = a
+			} else {
+				table[key] = assertion{Expr: expr, File: file, Line: first}
+			}
+		}
+	}
+}
+
+// decode turns a compact record into a test message.
+func (table assertionTable) decode(record string) (*testMsg, error) {
+	t := strings.Split(strings.TrimPrefix(strings.TrimSpace(record), "#"), ":")
+	if len(t) != 3 {
+		return nil, fmt.Errorf("malformed compact record: %s", record)
+	}
+	hash, err := strconv.ParseUint(t[0], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed compact record: %s", record)
+	}
+	line, err := strconv.Atoi(t[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed compact record: %s", record)
+	}
+
+	msg := &testMsg{
+		Result: t[2] == "1",
+		Fatal:  t[2] == "2",
+		Line:   line,
+	}
+	if a, ok := table[assertionKey{uint16(hash), line}]; ok {
+		msg.Expr = a.Expr
+		msg.File = a.File
+		msg.Line = a.Line
+	} else {
+		msg.Expr = "<unknown assertion>"
+		msg.File = fmt.Sprintf("#%s", t[0])
+	}
+	return msg, nil
+}
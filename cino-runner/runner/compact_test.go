@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCompact(t *testing.T) {
+	table := make(assertionTable)
+	scanSource(table, "test.ino", `#include <cino.h>
+
+void setup() {
+    TEST_PLAN(2);
+    REQUIRE( foo(1,  2) == 3 );
+    CHECK( bar() &&
+        baz() );
+}
+`)
+	hash := compactFileHash("/tmp/sketch/test.ino")
+	if hash != compactFileHash("test.ino") {
+		t.Error("File hash should only depend on the base name")
+	}
+
+	msg, err := table.decode(fmt.Sprintf("#%X:5:1\r\n", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Result || msg.Fatal || msg.Expr != "foo(1, 2) == 3" || msg.File != "test.ino" || msg.Line != 5 {
+		t.Errorf("Wrong decoded message: %+v", msg)
+	}
+
+	msg, err = table.decode(fmt.Sprintf("#%X:7:2", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Result || !msg.Fatal || msg.Expr != "bar() && baz()" || msg.Line != 6 {
+		t.Errorf("Wrong decoded message: %+v", msg)
+	}
+
+	if _, err := table.decode("#zz:1"); err == nil {
+		t.Error("Malformed record not detected")
+	}
+}
+
+func TestScanAssertions(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"sketch.ino":               "void setup() {\n  CHECK(a());\n}\n",
+		"src/helper.cpp":           "void f() {\n  REQUIRE(b());\n}\n",
+		"src/util/deep.h":          "\n\nCHECK(c());\n",
+		"src/util/notes.txt":       "CHECK(d());\n",
+		"extras/example/other.cpp": "CHECK(e());\n",
+	})
+	defer os.RemoveAll(dir)
+	table, err := scanAssertions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := assertionTable{
+		{compactFileHash("sketch.ino"), 2}: {Expr: "a()", File: "sketch.ino", Line: 2},
+		{compactFileHash("helper.cpp"), 2}: {Expr: "b()", File: "src/helper.cpp", Line: 2},
+		{compactFileHash("deep.h"), 3}:     {Expr: "c()", File: "src/util/deep.h", Line: 3},
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("got %v, expected %v", table, expected)
+	}
+}
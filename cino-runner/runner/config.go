@@ -9,9 +9,48 @@ import (
 )
 
 type Device struct {
-	FQBN     string
-	Port     string
-	Features []string
+	FQBN            string // for PlatformIO devices, the name of the environment
+	Backend         string // build backend: arduino-cli (default) or platformio
+	Kind            string // board (default), native, simavr or qemu
+	Port            string // port used for uploading (not needed by some upload methods)
+	MonitorPort     string `mapstructure:"monitor_port"`   // port used for reading test output, if different
+	MonitorSerial   string `mapstructure:"monitor_serial"` // serial object used by cino.h, such as Serial1
+	SerialNumber    string `mapstructure:"serial_number"`  // USB serial number, for looking up Port
+	VIDPID          string `mapstructure:"vid_pid"`        // USB VID:PID, for looking up Port
+	USBPath         string `mapstructure:"usb_path"`       // physical USB path such as 1-1.2, for looking up Port
+	Features        []string
+	BaudRate        int      `mapstructure:"baud_rate"`
+	SerialConfig    string   `mapstructure:"serial_config"`
+	Defines         []string // preprocessor symbols, such as LED_PIN=13
+	BuildProperties []string `mapstructure:"build_properties"` // such as build.f_cpu=8000000L
+	Upload          UploadConfig
+	Emulator        EmulatorConfig
+	Hooks           Hooks
+}
+
+// Monitor returns the port to read test output from.
+func (d *Device) Monitor() string {
+	if d.MonitorPort != "" {
+		return d.MonitorPort
+	}
+	return d.Port
+}
+
+// HasSeparateMonitor returns true if test output is read from a port other
+// than the upload one.
+func (d *Device) HasSeparateMonitor() bool {
+	return d.MonitorPort != "" && d.MonitorPort != d.Port
+}
+
+// Ports returns all the ports used by the device.
+func (d *Device) Ports() (out []string) {
+	if d.Port != "" {
+		out = append(out, d.Port)
+	}
+	if d.HasSeparateMonitor() {
+		out = append(out, d.MonitorPort)
+	}
+	return out
 }
 
 var Config struct {
@@ -19,6 +58,11 @@ var Config struct {
 	Wiring   []string
 	Devices  []Device
 	DB       lib.DBConfig
+	Cache    CacheConfig
+
+	BoardManager struct {
+		AdditionalURLs []string `mapstructure:"additional_urls"` // third-party package indexes
+	} `mapstructure:"board_manager"`
 }
 
 func LoadConfig(path string) error {
@@ -26,6 +70,8 @@ func LoadConfig(path string) error {
 	viper.SetConfigType("yaml")
 
 	viper.SetDefault("db.dsn", "localhost:5433")
+	viper.SetDefault("cache.max_age", "720h")
+	viper.SetDefault("cache.index_max_age", "24h")
 
 	if path != "" {
 		file, err := os.Open(path)
@@ -43,5 +89,11 @@ func LoadConfig(path string) error {
 
 	viper.Unmarshal(&Config)
 
+	for i, d := range Config.Devices {
+		if d.Kind == KindNative && d.FQBN == "" {
+			Config.Devices[i].FQBN = NativeFQBN
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/alranel/cino/lib"
+	"github.com/otiai10/copy"
+	"gopkg.in/ini.v1"
+)
+
+// localCore describes the core under test, which is installed from the
+// local checkout instead of the package index.
+type localCore struct {
+	ID      string // vendor:arch
+	Name    string // name from platform.txt
+	Version string // version from platform.txt
+	Path    string
+
+	// Version of the released core to install for providing the tools needed
+	// by the local one; empty for the latest.
+	ToolsVersion string
+}
+
+// findLocalCore reads the platform.txt of the core under test and determines
+// its vendor and architecture, either from the core-id key in cino.yml or by
+// looking up the core name in the package indexes.
+func findLocalCore(dataDir string, test *Test) (*localCore, error) {
+	f, err := ini.Load(filepath.Join(test.PackagePath, "platform.txt"))
+	if err != nil {
+		return nil, err
+	}
+	core := &localCore{
+		ID:      test.CoreID,
+		Name:    f.Section("").Key("name").String(),
+		Version: f.Section("").Key("version").String(),
+		Path:    test.PackagePath,
+	}
+
+	releases, err := indexedPlatforms(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if core.ID == "" {
+		for _, r := range releases {
+			if r.Name == core.Name {
+				core.ID = r.ID
+				break
+			}
+		}
+		if core.ID == "" {
+			return nil, fmt.Errorf("cannot detect vendor and architecture of core %q, please set core-id in cino.yml", core.Name)
+		}
+	}
+
+	// Use the tools of the released version matching the local one, if any
+	for _, r := range releases {
+		if r.ID == core.ID && r.Version == core.Version {
+			core.ToolsVersion = r.Version
+		}
+	}
+	return core, nil
+}
+
+// install copies the core to the hardware directory of the given arduino-cli
+// user directory, which takes precedence over the installed cores.
+func (c *localCore) install(userDir string) error {
+	parts := strings.SplitN(c.ID, ":", 2)
+	dest := filepath.Join(userDir, "hardware", parts[0], parts[1])
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	return copy.Copy(c.Path, dest, copy.Options{
+		Skip: func(src string) (bool, error) {
+			return filepath.Base(src) == ".git", nil
+		},
+	})
+}
+
+// indexedPlatform is a core release listed in a package index.
+type indexedPlatform struct {
+	ID      string // vendor:arch
+	Name    string
+	Version string
+}
+
+// indexedPlatforms returns all the core releases listed in the package
+// indexes found in dataDir.
+func indexedPlatforms(dataDir string) ([]indexedPlatform, error) {
+	files, err := filepath.Glob(filepath.Join(dataDir, "package_*index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []indexedPlatform
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var index struct {
+			Packages []struct {
+				Name      string
+				Platforms []struct {
+					Name         string
+					Architecture string
+					Version      string
+				}
+			}
+		}
+		if err := json.Unmarshal(data, &index); err != nil {
+			// Ignore broken third-party indexes
+			continue
+		}
+		for _, pkg := range index.Packages {
+			for _, p := range pkg.Platforms {
+				out = append(out, indexedPlatform{
+					ID:      pkg.Name + ":" + p.Architecture,
+					Name:    p.Name,
+					Version: p.Version,
+				})
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/alranel/cino/lib"
+)
+
+func TestFindLocalCore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "package_index.json"), []byte(`{"packages":[{"name":"arduino","platforms":[
+		{"name":"Arduino AVR Boards","architecture":"avr","version":"1.8.2"},
+		{"name":"Arduino AVR Boards","architecture":"avr","version":"1.8.3"}]}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "platform.txt"), []byte("name=Arduino AVR Boards\nversion=1.8.2\n"), 0644)
+
+	test := &Test{PackagePath: dir}
+	core, err := findLocalCore(dir, test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core.ID != "arduino:avr" || core.ToolsVersion != "1.8.2" {
+		t.Errorf("got %+v", core)
+	}
+
+	// Unreleased versions use the latest tools
+	ioutil.WriteFile(filepath.Join(dir, "platform.txt"), []byte("name=Arduino AVR Boards\nversion=1.9.0\n"), 0644)
+	if core, _ = findLocalCore(dir, test); core.ToolsVersion != "" {
+		t.Errorf("got %+v", core)
+	}
+
+	// Unknown cores need to be declared
+	ioutil.WriteFile(filepath.Join(dir, "platform.txt"), []byte("name=My Boards\nversion=0.1.0\n"), 0644)
+	if _, err = findLocalCore(dir, test); err == nil {
+		t.Errorf("expected error for unknown core")
+	}
+	test.CoreID = "me:avr"
+	if core, err = findLocalCore(dir, test); err != nil || core.ID != "me:avr" {
+		t.Errorf("got %+v, %v", core, err)
+	}
+}
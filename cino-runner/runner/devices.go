@@ -10,17 +10,25 @@ import (
 )
 
 func MatchDevice(skreq *SketchRequirements, dev Device) bool {
+	if backendName(skreq.Backend) != backendName(dev.Backend) {
+		return false
+	}
+
 	if skreq.RequireFQBN != "" && skreq.RequireFQBN != "*" && skreq.RequireFQBN != dev.FQBN {
 		return false
 	}
 
 	if skreq.RequireArchitecture != "" && skreq.RequireArchitecture != "*" {
 		t := strings.SplitN(dev.FQBN, ":", 3)
-		if skreq.RequireArchitecture != t[1] {
+		if len(t) < 2 || skreq.RequireArchitecture != t[1] {
 			return false
 		}
 	}
 
+	if len(skreq.ProfileFQBNs) > 0 && !funk.ContainsString(skreq.ProfileFQBNs, BoardFQBN(dev.FQBN)) {
+		return false
+	}
+
 	if len(funk.SubtractString(skreq.RequireFeatures, dev.Features)) > 0 {
 		return false
 	}
@@ -131,4 +131,25 @@ func TestAssignDevices(t *testing.T) {
 			t.Error("Wrong device returned")
 		}
 	}
+
+	{
+		Config.Devices = []Device{
+			{FQBN: "uno", Backend: BackendPlatformIO},
+			{FQBN: "arduino:avr:uno"},
+		}
+		test := TestRequirements{
+			Sketches: []SketchRequirements{
+				{RequireFQBN: "uno", Backend: BackendPlatformIO},
+				{RequireArchitecture: "avr"},
+			},
+		}
+		devices := AssignDevices(test)
+		if len(devices) != len(test.Sketches) {
+			t.Error("Wrong number of devices returned")
+		}
+		if devices[0].Backend != BackendPlatformIO || devices[1].FQBN != "arduino:avr:uno" {
+			t.Logf("%v", devices)
+			t.Error("Wrong devices returned")
+		}
+	}
 }
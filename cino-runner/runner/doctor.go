@@ -0,0 +1,403 @@
+package runner
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/alranel/cino/lib"
+	_ "github.com/lib/pq"
+	"github.com/thoas/go-funk"
+)
+
+// minCLIVersion is the oldest arduino-cli version supporting all the flags we use.
+var minCLIVersion = []int{0, 18, 0}
+
+// minFreeDiskSpace is the disk space needed for installing cores and compiling.
+const minFreeDiskSpace = 2 << 30
+
+// packageIndexURL is the URL of the main index of arduino-cli packages.
+const packageIndexURL = "https://downloads.arduino.cc/packages/package_index.json"
+
+// Check is the result of a single check about the runner environment.
+type Check struct {
+	Name    string
+	OK      bool
+	Warning bool   // the check did not pass, but the runner can work anyway
+	Details string // what was found
+	Hint    string // how to fix the problem
+}
+
+// Doctor checks whether the runner environment is properly set up.
+// If client is true, the settings needed for client mode are checked too.
+func Doctor(client bool) (out []Check) {
+	out = append(out, checkCLI())
+	for _, d := range Config.Devices {
+		if d.Backend == BackendPlatformIO {
+			out = append(out, checkPlatformIO())
+			break
+		}
+	}
+	cache := DefaultCache()
+	out = append(out, checkTempDir())
+	out = append(out, checkCacheDir(cache))
+	out = append(out, checkDiskSpace(cache))
+	out = append(out, checkPackageIndex())
+	out = append(out, checkCores(cache)...)
+	out = append(out, checkDevices()...)
+	if client {
+		out = append(out, checkRunnerID())
+		out = append(out, checkDB())
+	}
+	return out
+}
+
+func checkCLI() Check {
+	c := Check{Name: "arduino-cli"}
+	path, err := exec.LookPath("arduino-cli")
+	if err != nil {
+		c.Details = "not found in PATH"
+		c.Hint = "install arduino-cli (https://arduino.github.io/arduino-cli/latest/installation/) and make sure it's in PATH"
+		return c
+	}
+	out, err := exec.Command(path, "version").Output()
+	if err != nil {
+		c.Details = fmt.Sprintf("%s version failed: %s", path, err)
+		c.Hint = "check that the arduino-cli binary is not corrupted and can be executed by this user"
+		return c
+	}
+	res := regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`).FindStringSubmatch(string(out))
+	if res == nil {
+		c.Details = fmt.Sprintf("%s (unknown version)", path)
+		c.OK = true
+		c.Warning = true
+		c.Hint = "make sure arduino-cli is a release build"
+		return c
+	}
+	c.Details = fmt.Sprintf("%s (version %s)", path, res[0])
+	for i, min := range minCLIVersion {
+		v, _ := strconv.Atoi(res[i+1])
+		if v > min {
+			break
+		} else if v < min {
+			c.Hint = fmt.Sprintf("upgrade arduino-cli to version %d.%d.%d or later",
+				minCLIVersion[0], minCLIVersion[1], minCLIVersion[2])
+			return c
+		}
+	}
+	c.OK = true
+	return c
+}
+
+func checkPlatformIO() Check {
+	c := Check{Name: "platformio"}
+	path, err := exec.LookPath("pio")
+	if err != nil {
+		c.Details = "not found in PATH"
+		c.Hint = "install PlatformIO Core (https://docs.platformio.org/en/latest/core/installation/) and make sure pio is in PATH"
+		return c
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		c.Details = fmt.Sprintf("%s --version failed: %s", path, err)
+		c.Hint = "check that PlatformIO Core is properly installed"
+		return c
+	}
+	c.Details = fmt.Sprintf("%s (%s)", path, strings.TrimSpace(string(out)))
+	c.OK = true
+	return c
+}
+
+func checkTempDir() Check {
+	c := Check{Name: "Temporary directory"}
+	dir, err := ioutil.TempDir("/tmp", ".cino-doctor")
+	if err != nil {
+		c.Details = err.Error()
+		c.Hint = "make sure /tmp exists and is writable by this user"
+		return c
+	}
+	os.RemoveAll(dir)
+	c.Details = "/tmp is writable"
+	c.OK = true
+	return c
+}
+
+// checkCacheDir checks that the cache, where cores and downloads are
+// installed, is writable.
+func checkCacheDir(cache *Cache) Check {
+	c := Check{Name: "Cache directory"}
+	if err := os.MkdirAll(cache.Dir, os.ModePerm); err != nil {
+		c.Details = err.Error()
+		c.Hint = "set cache.dir in the configuration file to a directory writable by this user"
+		return c
+	}
+	dir, err := ioutil.TempDir(cache.Dir, ".cino-doctor")
+	if err != nil {
+		c.Details = err.Error()
+		c.Hint = "set cache.dir in the configuration file to a directory writable by this user"
+		return c
+	}
+	os.RemoveAll(dir)
+	c.Details = cache.Dir + " is writable"
+	c.OK = true
+	return c
+}
+
+// checkDiskSpace checks the space available for compiling, in /tmp, and for
+// installing cores, in the cache.
+func checkDiskSpace(cache *Cache) Check {
+	c := Check{Name: "Disk space"}
+	var details []string
+	for _, dir := range []string{"/tmp", cache.Dir} {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			c.Details = err.Error()
+			c.OK = true
+			c.Warning = true
+			return c
+		}
+		details = append(details, fmt.Sprintf("%d MB available in %s", free>>20, dir))
+		if free < minFreeDiskSpace {
+			c.Hint = fmt.Sprintf("free some space in %s: at least %d MB are needed for installing cores and compiling", dir, minFreeDiskSpace>>20)
+		}
+	}
+	c.Details = strings.Join(details, ", ")
+	c.OK = c.Hint == ""
+	return c
+}
+
+func checkPackageIndex() Check {
+	c := Check{Name: "Package index"}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Head(packageIndexURL)
+	if err != nil {
+		c.Details = err.Error()
+		c.Hint = "cores and libraries cannot be installed: check the internet connection and proxy settings"
+		return c
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Details = fmt.Sprintf("%s returned %s", packageIndexURL, resp.Status)
+		c.Hint = "cores and libraries cannot be installed: check the internet connection and proxy settings"
+		return c
+	}
+	c.Details = packageIndexURL + " is reachable"
+	c.OK = true
+	return c
+}
+
+// checkCores checks that the cores of the configured devices are installed in
+// the cache, or can be installed from the package indexes. Missing indexes are
+// downloaded to a temporary directory, leaving the cache untouched.
+func checkCores(cache *Cache) (out []Check) {
+	var ids []string
+	for _, d := range Config.Devices {
+		if d.Kind == KindNative || backendName(d.Backend) != "arduino-cli" {
+			continue
+		}
+		if t := strings.Split(d.FQBN, ":"); len(t) >= 3 && !funk.ContainsString(ids, t[0]+":"+t[1]) {
+			ids = append(ids, t[0]+":"+t[1])
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	installed := make(map[string]string)
+	if platforms, err := cache.Platforms(); err == nil {
+		for _, p := range platforms {
+			installed[p.ID] = p.Version
+		}
+	}
+
+	var indexErrors []string
+	available := make(map[string]string)
+	tmpDir, err := ioutil.TempDir("", ".cino-doctor")
+	if err != nil {
+		indexErrors = append(indexErrors, err.Error())
+	} else {
+		defer os.RemoveAll(tmpDir)
+		for _, u := range append([]string{packageIndexURL}, Config.BoardManager.AdditionalURLs...) {
+			if _, err := os.Stat(filepath.Join(cache.DataDir(), indexFileName(u))); err == nil {
+				continue
+			}
+			if _, err := downloadFile(u, tmpDir); err != nil {
+				indexErrors = append(indexErrors, err.Error())
+			}
+		}
+		for _, dir := range []string{cache.DataDir(), tmpDir} {
+			releases, _ := indexedPlatforms(dir)
+			for _, r := range releases {
+				if compareVersions(r.Version, available[r.ID]) > 0 {
+					available[r.ID] = r.Version
+				}
+			}
+		}
+	}
+
+	for _, id := range ids {
+		c := Check{Name: "Core " + id}
+		if version, ok := installed[id]; ok {
+			c.Details = fmt.Sprintf("installed (%s)", version)
+			c.OK = true
+		} else if version, ok := available[id]; ok {
+			c.Details = fmt.Sprintf("installable (latest version %s)", version)
+			c.OK = true
+		} else if len(indexErrors) > 0 {
+			c.Details = "not installed, and the package indexes could not be read: " + strings.Join(indexErrors, ", ")
+			c.Hint = "check the internet connection and the board_manager.additional_urls setting"
+		} else {
+			// Tests can still add the index of the core in their cino.yml
+			c.Details = "not installed, and not found in the package indexes"
+			c.OK = true
+			c.Warning = true
+			c.Hint = "check the FQBN of the devices, or add the package index of the vendor to board_manager.additional_urls"
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func checkDevices() (out []Check) {
+	if len(Config.Devices) == 0 {
+		return []Check{{
+			Name:    "Devices",
+			Details: "no devices configured",
+			Hint:    "add boards to the devices section of the configuration file (see cino-runner devices)",
+		}}
+	}
+	for i := range Config.Devices {
+		d := Config.Devices[i]
+		c := Check{Name: fmt.Sprintf("Device %d (%s)", i, d.FQBN)}
+		if d.FQBN == "" {
+			c.Details = "no FQBN configured"
+			c.Hint = "set the fqbn key (see arduino-cli board list)"
+			out = append(out, c)
+			continue
+		}
+		if d.IsVirtual() {
+			out = append(out, checkVirtualDevice(c, &d))
+			continue
+		}
+		if err := d.ResolvePort(); err != nil {
+			c.Details = err.Error()
+			c.Hint = "check that the board is connected and its USB properties are correct (see cino-runner devices)"
+			out = append(out, c)
+			continue
+		}
+		if len(d.Ports()) == 0 {
+			c.Details = "no port configured"
+			c.Hint = "set the port key, or the monitor_port key if the board is uploaded without a serial port"
+			out = append(out, c)
+			continue
+		}
+		var problems []string
+		for _, port := range d.Ports() {
+			if _, err := os.Stat(port); err != nil {
+				problems = append(problems, fmt.Sprintf("%s does not exist", port))
+			} else if err := checkWritable(port); err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not writable", port))
+			}
+		}
+		if len(problems) > 0 {
+			c.Details = strings.Join(problems, ", ")
+			c.Hint = "check that the board is connected, and that this user has access to the port (e.g. it belongs to the dialout group)"
+			out = append(out, c)
+			continue
+		}
+		c.Details = strings.Join(d.Ports(), ", ")
+		c.OK = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// checkVirtualDevice checks that the program needed for running sketches on
+// the host, either natively or in an emulator, is installed.
+func checkVirtualDevice(c Check, d *Device) Check {
+	var program, hint string
+	switch d.Kind {
+	case KindNative:
+		program = os.Getenv("CXX")
+		if program == "" {
+			program = "c++"
+		}
+		hint = "install a C++ compiler such as g++ or clang, or set the CXX environment variable"
+	case KindSimavr, KindQEMU:
+		if _, err := runCommand(d, Artifacts{}); err != nil {
+			c.Details = err.Error()
+			c.Hint = "configure the emulator key of the device"
+			return c
+		}
+		program, hint = "simavr", "install simavr, or set emulator.command"
+		if d.Kind == KindQEMU {
+			program, hint = "qemu-system-arm", "install QEMU, or set emulator.command"
+		}
+		if d.Emulator.Command != "" {
+			program = "sh"
+		}
+	default:
+		c.Details = fmt.Sprintf("unknown kind %s", d.Kind)
+		c.Hint = "set the kind key to board, native, simavr or qemu"
+		return c
+	}
+	path, err := exec.LookPath(program)
+	if err != nil {
+		c.Details = fmt.Sprintf("%s not found in PATH", program)
+		c.Hint = hint
+		return c
+	}
+	c.Details = fmt.Sprintf("%s (%s)", d.Kind, path)
+	c.OK = true
+	return c
+}
+
+func checkRunnerID() Check {
+	c := Check{Name: "Runner ID"}
+	if Config.RunnerID == "" {
+		c.Details = "runner_id not configured"
+		c.Hint = "set runner_id in the configuration file, and list it in the cino-server configuration"
+		return c
+	}
+	c.Details = Config.RunnerID
+	c.OK = true
+	return c
+}
+
+func checkDB() Check {
+	c := Check{Name: "Database"}
+	if Config.DB.DSN == "" {
+		c.Details = "db.dsn not configured"
+		c.Hint = "set db.dsn in the configuration file using the credentials configured in cino-server"
+		return c
+	}
+	db, err := sql.Open("postgres", Config.DB.DSN)
+	if err != nil {
+		c.Details = err.Error()
+		c.Hint = "check the syntax of db.dsn"
+		return c
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		c.Details = err.Error()
+		c.Hint = "check that cino-server's database is reachable from this machine and that the credentials in db.dsn are correct"
+		return c
+	}
+	var jobs int
+	if err := db.QueryRow("select count(*) from jobs where status = 'queued'").Scan(&jobs); err != nil {
+		c.Details = err.Error()
+		c.Hint = "check that the database schema was initialized by cino-server"
+		return c
+	}
+	c.Details = fmt.Sprintf("connected, %d job(s) queued", jobs)
+	c.OK = true
+	return c
+}
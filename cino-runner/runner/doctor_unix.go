@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package runner
+
+import "syscall"
+
+func checkWritable(path string) error {
+	return syscall.Access(path, 2) // W_OK
+}
+
+func freeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
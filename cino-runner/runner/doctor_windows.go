@@ -0,0 +1,11 @@
+package runner
+
+import "errors"
+
+func checkWritable(path string) error {
+	return nil
+}
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
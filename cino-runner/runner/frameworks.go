@@ -0,0 +1,153 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sketches written for other test frameworks print their own textual format
+// over serial. A framework parser turns those lines into the messages that
+// cino.h would print, so that the same test model applies to all of them:
+// each test case becomes a result, and the final summary marks the test as
+// done. Frameworks that do not announce the number of cases run with no plan.
+
+// frameworkParser parses the output of a test framework. parse returns the
+// messages corresponding to a line, or none if the line has no meaning for
+// the test results (in which case it is only kept in the full log).
+type frameworkParser interface {
+	parse(line string) []testMsg
+}
+
+// frameworkParsers lists the supported frameworks, besides cino.h itself.
+var frameworkParsers = map[string]func() frameworkParser{
+	"aunit":       func() frameworkParser { return &testRunnerParser{startRe: aunitStartRe, summaryRe: aunitSummaryRe} },
+	"arduinounit": func() frameworkParser { return &testRunnerParser{summaryRe: arduinoUnitSummaryRe} },
+	"unity":       func() frameworkParser { return &unityParser{} },
+}
+
+// newFrameworkParser returns the parser for the given framework, or nil for
+// sketches using cino.h.
+func newFrameworkParser(framework string) (frameworkParser, error) {
+	if framework == "" || framework == "cino" {
+		return nil, nil
+	}
+	newParser, ok := frameworkParsers[framework]
+	if !ok {
+		return nil, fmt.Errorf("unknown test framework: %s", framework)
+	}
+	return newParser(), nil
+}
+
+// AUnit and ArduinoUnit print a line for each test case, preceded by the
+// failed assertions, and a summary at the end:
+//
+//	TestRunner started on 2 test(s).
+//	Assertion failed: (a=1) == (b=2), file basic.ino, line 12.
+//	Test bad failed.
+//	Test good passed.
+//	TestRunner summary: 1 passed, 1 failed, 0 skipped, 0 timed out, out of 2 test(s).
+//
+// The first and the last lines are specific to AUnit, while ArduinoUnit prints
+// "Test summary: ..." and does not announce the number of cases.
+var (
+	aunitStartRe         = regexp.MustCompile(`^TestRunner started on (\d+) test`)
+	aunitSummaryRe       = regexp.MustCompile(`^TestRunner summary:`)
+	arduinoUnitSummaryRe = regexp.MustCompile(`^Test summary:`)
+	testCaseRe           = regexp.MustCompile(`^Test (\S+) (passed|failed|skipped|expired|timed out)\.?$`)
+	failedAssertionRe    = regexp.MustCompile(`^Assertion failed: (.*), file (.+), line (\d+)`)
+)
+
+type testRunnerParser struct {
+	startRe   *regexp.Regexp // line declaring the number of test cases, if any
+	summaryRe *regexp.Regexp
+	planned   bool
+	// Last failed assertion of the running test case
+	failure string
+	file    string
+	line    int
+}
+
+func (p *testRunnerParser) parse(line string) (out []testMsg) {
+	line = strings.TrimSpace(line)
+	if p.startRe != nil {
+		if m := p.startRe.FindStringSubmatch(line); m != nil && !p.planned {
+			p.planned = true
+			n, _ := strconv.Atoi(m[1])
+			return []testMsg{{Plan: n}}
+		}
+	}
+	if m := failedAssertionRe.FindStringSubmatch(line); m != nil {
+		p.failure, p.file = m[1], m[2]
+		p.line, _ = strconv.Atoi(m[3])
+		return nil
+	}
+	if p.summaryRe.MatchString(line) {
+		return []testMsg{{Done: true}}
+	}
+	m := testCaseRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	if !p.planned {
+		p.planned = true
+		out = append(out, testMsg{Plan: -1})
+	}
+	msg := testMsg{Expr: m[1], Result: true}
+	switch m[2] {
+	case "skipped":
+		msg.Expr += " (skipped)"
+	case "failed", "expired", "timed out":
+		msg.Result = false
+		if p.failure != "" {
+			msg.Expr += ": " + p.failure
+			msg.File, msg.Line = p.file, p.line
+		} else if m[2] != "failed" {
+			msg.Expr += " (" + m[2] + ")"
+		}
+	}
+	p.failure, p.file, p.line = "", "", 0
+	return append(out, msg)
+}
+
+// Unity prints a line for each test case, followed by a summary:
+//
+//	test_math.c:12:test_add:PASS
+//	test_math.c:20:test_sub:FAIL: Expected 1 Was 2
+//	test_math.c:28:test_div:IGNORE
+//	-----------------------
+//	3 Tests 1 Failures 1 Ignored
+//	FAIL
+var (
+	unityResultRe  = regexp.MustCompile(`^(.+?):(\d+):(\w+):(PASS|FAIL|IGNORE)(?::\s*(.*))?$`)
+	unitySummaryRe = regexp.MustCompile(`^\d+ Tests \d+ Failures \d+ Ignored`)
+)
+
+type unityParser struct {
+	planned bool
+}
+
+func (p *unityParser) parse(line string) (out []testMsg) {
+	line = strings.TrimSpace(line)
+	if unitySummaryRe.MatchString(line) {
+		return []testMsg{{Done: true}}
+	}
+	m := unityResultRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	if !p.planned {
+		p.planned = true
+		out = append(out, testMsg{Plan: -1})
+	}
+	msg := testMsg{Expr: m[3], File: m[1], Result: m[4] != "FAIL"}
+	msg.Line, _ = strconv.Atoi(m[2])
+	if m[4] == "IGNORE" {
+		msg.Expr += " (ignored)"
+	}
+	if m[5] != "" {
+		msg.Expr += ": " + m[5]
+	}
+	return append(out, msg)
+}
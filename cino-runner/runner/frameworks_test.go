@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseOutput feeds the given output to the parser of a framework, one line
+// at a time, returning all the messages produced.
+func parseOutput(t *testing.T, framework, output string) (out []testMsg) {
+	parser, err := newFrameworkParser(framework)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		out = append(out, parser.parse(line)...)
+	}
+	return out
+}
+
+func TestParseAUnit(t *testing.T) {
+	got := parseOutput(t, "aunit", `TestRunner started on 4 test(s).
+Test good passed.
+Assertion failed: (a=1) == (b=2), file AUnitTest.ino, line 12.
+Test bad failed.
+Test later skipped.
+Test slow expired.
+TestRunner duration: 0.005 seconds.
+TestRunner summary: 1 passed, 1 failed, 1 skipped, 1 timed out, out of 4 test(s).
+`)
+	expected := []testMsg{
+		{Plan: 4},
+		{Expr: "good", Result: true},
+		{Expr: "bad: (a=1) == (b=2)", File: "AUnitTest.ino", Line: 12},
+		{Expr: "later (skipped)", Result: true},
+		{Expr: "slow (expired)"},
+		{Done: true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
+
+func TestParseArduinoUnit(t *testing.T) {
+	got := parseOutput(t, "arduinounit", "Test good passed.\r\n"+
+		"Assertion failed: (x=3) < (max=2), file basic.ino, line 20.\r\n"+
+		"Test bad failed.\r\n"+
+		"Test summary: 1 passed, 1 failed, and 0 skipped, out of 2 test(s).\r\n")
+	expected := []testMsg{
+		{Plan: -1},
+		{Expr: "good", Result: true},
+		{Expr: "bad: (x=3) < (max=2)", File: "basic.ino", Line: 20},
+		{Done: true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
+
+func TestParseUnity(t *testing.T) {
+	got := parseOutput(t, "unity", `test_math.c:12:test_add:PASS
+test_math.c:20:test_sub:FAIL: Expected 1 Was 2
+test_math.c:28:test_div:IGNORE
+
+-----------------------
+3 Tests 1 Failures 1 Ignored
+FAIL
+`)
+	expected := []testMsg{
+		{Plan: -1},
+		{Expr: "test_add", File: "test_math.c", Line: 12, Result: true},
+		{Expr: "test_sub: Expected 1 Was 2", File: "test_math.c", Line: 20},
+		{Expr: "test_div (ignored)", File: "test_math.c", Line: 28, Result: true},
+		{Done: true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
+
+func TestNewFrameworkParser(t *testing.T) {
+	if p, err := newFrameworkParser("cino"); p != nil || err != nil {
+		t.Errorf("expected no parser for cino.h")
+	}
+	if _, err := newFrameworkParser("junit"); err == nil {
+		t.Errorf("expected error for unknown framework")
+	}
+}
@@ -0,0 +1,42 @@
+//go:build ignore
+// +build ignore
+
+// This program generates cinoh.go, embedding the cino.h header from the
+// cino library so that the runner and the library never drift apart.
+// It is invoked by running go generate in the runner package.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+)
+
+func main() {
+	cinoh, err := ioutil.ReadFile("../../cino-library/src/cino.h")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bytes.ContainsRune(cinoh, '`') {
+		log.Fatal("cino.h cannot contain backticks")
+	}
+
+	res := regexp.MustCompile(`#define CINO_PROTOCOL_VERSION (\d+)`).FindSubmatch(cinoh)
+	if res == nil {
+		log.Fatal("CINO_PROTOCOL_VERSION not found in cino.h")
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by gen_cinoh.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package runner\n\n")
+	fmt.Fprintf(&out, "// ProtocolVersion is the version of the protocol spoken by cino.h.\n")
+	fmt.Fprintf(&out, "const ProtocolVersion = %s\n\n", res[1])
+	fmt.Fprintf(&out, "// cinoH is the content of cino-library/src/cino.h.\n")
+	fmt.Fprintf(&out, "const cinoH = `%s`\n", cinoh)
+
+	if err := ioutil.WriteFile("cinoh.go", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build ignore
+// +build ignore
+
+// This program generates nativeshim.go, embedding the sources of the Arduino
+// API shim used for running test sketches on the host.
+// It is invoked by running go generate in the runner package.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+func main() {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by gen_native.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package runner\n\n")
+	fmt.Fprintf(&out, "// nativeShim maps the file names of the Arduino API shim in the native\n")
+	fmt.Fprintf(&out, "// directory to their content.\n")
+	fmt.Fprintf(&out, "var nativeShim = map[string]string{\n")
+	for _, name := range []string{"Arduino.h", "Arduino.cpp"} {
+		src, err := ioutil.ReadFile("native/" + name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if bytes.ContainsRune(src, '`') {
+			log.Fatalf("%s cannot contain backticks", name)
+		}
+		fmt.Fprintf(&out, "\t%q: `%s`,\n", name, src)
+	}
+	fmt.Fprintf(&out, "}\n")
+
+	if err := ioutil.WriteFile("nativeshim.go", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	. "github.com/alranel/cino/lib"
+)
+
+// Hooks are shell commands executed at specific points of the lifecycle of a
+// device, such as for power cycling or resetting a board.
+type Hooks struct {
+	BeforeTest   string `mapstructure:"before_test"`
+	BeforeUpload string `mapstructure:"before_upload"`
+	AfterUpload  string `mapstructure:"after_upload"`
+	AfterTest    string `mapstructure:"after_test"`
+	OnError      string `mapstructure:"on_error"`
+}
+
+// hookCommand returns the command for running the given hook, or nil if the
+// hook is not configured. The environment variables returned by hookEnv are
+// passed to the command.
+func hookCommand(hook string, env []string) *exec.Cmd {
+	if hook == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd
+}
+
+// hookEnv returns the environment variables describing the device, the test
+// and the job (if any) to hooks.
+func hookEnv(device *Device, sketchIdx int, test *Test, job *Job) []string {
+	env := []string{
+		"CINO_RUNNER_ID=" + Config.RunnerID,
+		"CINO_DEVICE_FQBN=" + device.FQBN,
+		"CINO_DEVICE_PORT=" + device.Port,
+		"CINO_DEVICE_MONITOR_PORT=" + device.Monitor(),
+		"CINO_TEST_PATH=" + test.Path,
+		"CINO_TEST_NAME=" + test.RelPath(),
+		"CINO_SKETCH_DIR=" + test.Sketches[sketchIdx].Dir,
+	}
+	if job != nil {
+		env = append(env,
+			fmt.Sprintf("CINO_JOB_ID=%d", job.ID),
+			"CINO_JOB_NAME="+job.Name(),
+		)
+	}
+	return env
+}
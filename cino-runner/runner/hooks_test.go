@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/alranel/cino/lib"
+)
+
+// recordingHooks returns hooks appending their name to an order file and
+// writing their CINO_* environment variables to a file named after them.
+func recordingHooks(dir string) Hooks {
+	hook := func(name string) string {
+		return fmt.Sprintf("echo %s >> %s/order; env | grep ^CINO_ | sort > %s/%s.env", name, dir, dir, name)
+	}
+	return Hooks{
+		BeforeTest:   hook("before_test"),
+		BeforeUpload: hook("before_upload"),
+		AfterUpload:  hook("after_upload"),
+		AfterTest:    hook("after_test"),
+		OnError:      hook("on_error"),
+	}
+}
+
+// readHookEnv returns the CINO_* variables received by a recorded hook.
+func readHookEnv(t *testing.T, dir, name string) map[string]string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name+".env"))
+	if err != nil {
+		t.Fatalf("%s hook did not run: %s", name, err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+func readHookOrder(t *testing.T, dir string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "order"))
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+func TestHooksOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Config.RunnerID = "lab1"
+	defer func() { Config.RunnerID = "" }()
+
+	tests, err := FindTests("../../examples/04_logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := []Device{{FQBN: "arduino:avr:uno", Port: "/dev/cino-missing", Hooks: recordingHooks(dir)}}
+	if err := RunTest(&tests[0], devices, &Job{ID: 42}); err == nil {
+		t.Fatal("expected error for missing port")
+	}
+
+	// The device failed before before_test, so only on_error and
+	// after_test ran, in this order.
+	if order := readHookOrder(t, dir); order != "on_error after_test" {
+		t.Errorf("wrong hook order: %s", order)
+	}
+	env := readHookEnv(t, dir, "on_error")
+	expected := map[string]string{
+		"CINO_RUNNER_ID":           "lab1",
+		"CINO_DEVICE_FQBN":         "arduino:avr:uno",
+		"CINO_DEVICE_PORT":         "/dev/cino-missing",
+		"CINO_DEVICE_MONITOR_PORT": "/dev/cino-missing",
+		"CINO_TEST_PATH":           tests[0].Path,
+		"CINO_TEST_NAME":           tests[0].RelPath(),
+		"CINO_SKETCH_DIR":          ".",
+		"CINO_JOB_ID":              "42",
+		"CINO_ERROR":               "1",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("on_error: %s = %q, expected %q", k, env[k], v)
+		}
+	}
+	if !strings.HasPrefix(env["CINO_JOB_NAME"], "Hardware test") {
+		t.Errorf("on_error: wrong CINO_JOB_NAME %q", env["CINO_JOB_NAME"])
+	}
+	if _, ok := env["CINO_TEST_STATUS"]; ok {
+		t.Errorf("on_error: unexpected CINO_TEST_STATUS")
+	}
+	env = readHookEnv(t, dir, "after_test")
+	if _, ok := env["CINO_TEST_STATUS"]; !ok || env["CINO_ERROR"] != "" {
+		t.Errorf("after_test: wrong environment %v", env)
+	}
+}
+
+func TestHooksNative(t *testing.T) {
+	if _, err := exec.LookPath("c++"); err != nil {
+		t.Skip("no C++ compiler available")
+	}
+	dir, err := ioutil.TempDir("", "cino-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests, err := FindTests("../../examples/04_logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := []Device{{Kind: KindNative, FQBN: NativeFQBN, Hooks: recordingHooks(dir)}}
+	if err := RunTest(&tests[0], devices, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is uploaded to native devices, and on_error is skipped on success.
+	if order := readHookOrder(t, dir); order != "before_test after_test" {
+		t.Errorf("wrong hook order: %s", order)
+	}
+	env := readHookEnv(t, dir, "after_test")
+	if env["CINO_TEST_STATUS"] != "success" || env["CINO_DEVICE_FQBN"] != NativeFQBN {
+		t.Errorf("after_test: wrong environment %v", env)
+	}
+	if _, ok := env["CINO_JOB_ID"]; ok {
+		t.Errorf("after_test: unexpected CINO_JOB_ID outside client mode")
+	}
+}
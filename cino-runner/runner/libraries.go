@@ -0,0 +1,179 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/alranel/cino/lib"
+	"github.com/otiai10/copy"
+	"gopkg.in/ini.v1"
+)
+
+// Sources of the libraries listed in cino.yml.
+const (
+	libraryManager = iota // name, optionally with a version, such as Servo@1.1.8
+	libraryGit            // git URL, optionally with a ref, such as https://github.com/foo/bar.git#v1.0.0
+	libraryZip            // URL or local path of a zip archive
+	libraryDir            // local path to a library directory, relative to the test
+)
+
+// parseLibrarySpec determines the source of a library listed in cino.yml.
+// For git URLs, the ref is returned separately.
+func parseLibrarySpec(spec string) (kind int, location, ref string) {
+	isURL := strings.Contains(spec, "://")
+	switch {
+	case strings.HasPrefix(spec, "git+"):
+		spec = strings.TrimPrefix(spec, "git+")
+		fallthrough
+	case strings.HasPrefix(spec, "git@") || (isURL && (strings.HasSuffix(spec, ".git") || strings.Contains(spec, ".git#"))):
+		location, ref = spec, ""
+		if i := strings.LastIndex(spec, "#"); i != -1 {
+			location, ref = spec[:i], spec[i+1:]
+		}
+		return libraryGit, location, ref
+	case strings.HasSuffix(strings.ToLower(spec), ".zip"):
+		return libraryZip, spec, ""
+	case isURL:
+		// Any other URL is assumed to be a git repository
+		location, ref = spec, ""
+		if i := strings.LastIndex(spec, "#"); i != -1 {
+			location, ref = spec[:i], spec[i+1:]
+		}
+		return libraryGit, location, ref
+	case strings.HasPrefix(spec, "."):
+		return libraryDir, spec, ""
+	}
+	return libraryManager, spec, ""
+}
+
+// installLibraryDir copies the library in src to librariesDir, returning its
+// name as declared in library.properties or library.json (or defaultName, if
+// missing).
+func installLibraryDir(src, defaultName, librariesDir string) (string, error) {
+	name := defaultName
+	if f, err := ini.Load(filepath.Join(src, "library.properties")); err == nil {
+		if n := f.Section("").Key("name").String(); n != "" {
+			name = n
+		}
+	} else if data, err := ioutil.ReadFile(filepath.Join(src, "library.json")); err == nil {
+		var manifest struct{ Name string }
+		if json.Unmarshal(data, &manifest) == nil && manifest.Name != "" {
+			name = manifest.Name
+		}
+	}
+	if !isSafeFileName(name) {
+		return "", fmt.Errorf("invalid library name: %s", name)
+	}
+	dest := filepath.Join(librariesDir, name)
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return "", err
+	}
+	return name, copy.Copy(src, dest, copy.Options{
+		Skip: func(src string) (bool, error) {
+			return filepath.Base(src) == ".git", nil
+		},
+	})
+}
+
+// installLibraryGit clones the library at the given git URL and ref (the
+// default branch, if empty) and copies it to librariesDir.
+func installLibraryGit(url, ref, librariesDir string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	dir, err := CloneRepo(url, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to clone %s at %s: %s", url, ref, err)
+	}
+	defer os.RemoveAll(dir)
+	return installLibraryDir(dir, strings.TrimSuffix(path.Base(url), ".git"), librariesDir)
+}
+
+// repoPath resolves a path relative to the test directory, making sure that
+// it does not point outside of the repository.
+func repoPath(test *Test, p string) (string, error) {
+	abs := filepath.Join(test.Path, p)
+	if rel, err := filepath.Rel(test.RepoPath, abs); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("path %s is outside of the repository", p)
+	}
+	return abs, nil
+}
+
+// downloadTimeout is how long downloading a file may take, including reading
+// the response body.
+const downloadTimeout = 5 * time.Minute
+
+// isSafeFileName returns true if name, which comes from the repository under
+// test or a URL, can be used as a file name without escaping its directory.
+func isSafeFileName(name string) bool {
+	return name != "" && name != "." && !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+// downloadFile downloads the given URL to dir, returning the path of the file.
+// The file is named after the last element of the URL path.
+func downloadFile(rawURL, dir string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if !isSafeFileName(name) {
+		return "", fmt.Errorf("cannot determine file name for %s", rawURL)
+	}
+	client := http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+	dest := filepath.Join(dir, name)
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return dest, err
+}
+
+var dependsRe = regexp.MustCompile(`^([^(]+?)\s*(?:\((.*)\))?$`)
+
+// libraryDepends returns the dependencies declared in the depends field of
+// the library.properties file of the given library, as specs to be passed to
+// arduino-cli lib install. Only exact version constraints are honored.
+func libraryDepends(libPath string) ([]string, error) {
+	f, err := ini.Load(filepath.Join(libPath, "library.properties"))
+	if os.IsNotExist(err) {
+		// PlatformIO libraries declare their dependencies in library.json,
+		// which are resolved by PlatformIO itself.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, dep := range strings.Split(f.Section("").Key("depends").String(), ",") {
+		m := dependsRe.FindStringSubmatch(strings.TrimSpace(dep))
+		if m == nil || m[1] == "" {
+			continue
+		}
+		spec := m[1]
+		if v := strings.TrimSpace(m[2]); strings.HasPrefix(v, "=") {
+			spec += "@" + strings.TrimSpace(v[1:])
+		}
+		out = append(out, spec)
+	}
+	return out, nil
+}
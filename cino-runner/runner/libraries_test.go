@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLibrarySpec(t *testing.T) {
+	tests := []struct {
+		spec          string
+		kind          int
+		location, ref string
+	}{
+		{"Servo@1.1.8", libraryManager, "Servo@1.1.8", ""},
+		{"Adafruit NeoPixel", libraryManager, "Adafruit NeoPixel", ""},
+		{"https://github.com/foo/bar.git#v1.0.0", libraryGit, "https://github.com/foo/bar.git", "v1.0.0"},
+		{"https://github.com/foo/bar", libraryGit, "https://github.com/foo/bar", ""},
+		{"git@github.com:foo/bar.git", libraryGit, "git@github.com:foo/bar.git", ""},
+		{"https://example.com/bar-1.0.zip", libraryZip, "https://example.com/bar-1.0.zip", ""},
+		{"https://foo.github.io/lib.zip", libraryZip, "https://foo.github.io/lib.zip", ""},
+		{"https://foo.github.io/lib", libraryGit, "https://foo.github.io/lib", ""},
+		{"https://example.com/foo.git/bar.zip", libraryZip, "https://example.com/foo.git/bar.zip", ""},
+		{"git+https://example.com/foo#main", libraryGit, "https://example.com/foo", "main"},
+		{"../libs/bar.zip", libraryZip, "../libs/bar.zip", ""},
+		{"./libs/bar", libraryDir, "./libs/bar", ""},
+	}
+	for _, tt := range tests {
+		kind, location, ref := parseLibrarySpec(tt.spec)
+		if kind != tt.kind || location != tt.location || ref != tt.ref {
+			t.Errorf("parseLibrarySpec(%q) = %d, %q, %q", tt.spec, kind, location, ref)
+		}
+	}
+}
+
+func TestLibraryDepends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "library.properties"),
+		[]byte("name=Foo\ndepends=ArduinoHttpClient, Arduino_DebugUtils (>=1.0.0), Adafruit BusIO (=1.7.1)\n"), 0644)
+
+	got, err := libraryDepends(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ArduinoHttpClient", "Arduino_DebugUtils", "Adafruit BusIO@1.7.1"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+
+	// Libraries only having library.json have no dependencies for arduino-cli
+	os.Remove(filepath.Join(dir, "library.properties"))
+	if got, err := libraryDepends(dir); err != nil || got != nil {
+		t.Errorf("got %v, %v without library.properties", got, err)
+	}
+}
+
+func TestInstallLibraryGitError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The error must include the output of git, explaining what went wrong
+	_, err = installLibraryGit(filepath.Join(dir, "missing.git"), "v1.0.0", dir)
+	if err == nil {
+		t.Fatal("expected error for missing repository")
+	}
+	if !strings.Contains(err.Error(), "git fetch") || !strings.Contains(err.Error(), "fatal:") {
+		t.Errorf("git output missing from error: %s", err)
+	}
+}
+
+func TestInstallLibraryDirName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	librariesDir := filepath.Join(dir, "libraries")
+	os.MkdirAll(src, os.ModePerm)
+
+	for _, name := range []string{"../../evil", "..", "foo/bar", `foo\bar`} {
+		ioutil.WriteFile(filepath.Join(src, "library.properties"), []byte("name="+name+"\n"), 0644)
+		if _, err := installLibraryDir(src, "default", librariesDir); err == nil {
+			t.Errorf("%s: expected error for unsafe library name", name)
+		}
+	}
+	os.Remove(filepath.Join(src, "library.properties"))
+	if _, err := installLibraryDir(src, "..", librariesDir); err == nil {
+		t.Errorf("expected error for unsafe default name")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files written outside of the libraries directory")
+	}
+
+	ioutil.WriteFile(filepath.Join(src, "library.properties"), []byte("name=Foo Bar\n"), 0644)
+	name, err := installLibraryDir(src, "default", librariesDir)
+	if err != nil || name != "Foo Bar" {
+		t.Errorf("got %q, %v", name, err)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The query string is not part of the file name
+	dest, err := downloadFile(server.URL+"/files/lib.zip?token=secret", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != filepath.Join(dir, "lib.zip") {
+		t.Errorf("wrong destination %s", dest)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "/files/lib.zip" {
+		t.Errorf("wrong contents %q", data)
+	}
+
+	for _, u := range []string{server.URL, server.URL + "/", server.URL + "/files/.."} {
+		if _, err := downloadFile(u, dir); err == nil {
+			t.Errorf("%s: expected error", u)
+		}
+	}
+}
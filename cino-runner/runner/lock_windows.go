@@ -0,0 +1,40 @@
+package runner
+
+import (
+	"os"
+	"sync"
+)
+
+// On Windows the cache is only protected against concurrent access from the
+// same process.
+var cacheMutex sync.RWMutex
+var cacheLocks = make(map[*os.File]bool)
+var cacheLocksMutex sync.Mutex
+
+func lockFile(f *os.File, exclusive bool) error {
+	unlockFile(f)
+	if exclusive {
+		cacheMutex.Lock()
+	} else {
+		cacheMutex.RLock()
+	}
+	cacheLocksMutex.Lock()
+	cacheLocks[f] = exclusive
+	cacheLocksMutex.Unlock()
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	cacheLocksMutex.Lock()
+	exclusive, locked := cacheLocks[f]
+	delete(cacheLocks, f)
+	cacheLocksMutex.Unlock()
+	if locked {
+		if exclusive {
+			cacheMutex.Unlock()
+		} else {
+			cacheMutex.RUnlock()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/alranel/cino/lib"
+)
+
+//go:generate go run gen_native.go
+
+// NativeFQBN is the FQBN of native devices, unless configured otherwise.
+const NativeFQBN = "cino:native:host"
+
+// native builds sketches for the host, against an implementation of the
+// Arduino API writing serial output to the standard output. Libraries are
+// installed as for arduino-cli builds, but no core is needed. The compiler
+// can be set through the CXX environment variable.
+type native struct {
+	arduinoCLI
+	exe string
+}
+
+func (b *native) Prepare() (err error) {
+	test := b.test
+	if test.PackageType == Core {
+		return fmt.Errorf("testing cores is not supported on native devices")
+	}
+
+	// arduino-cli is only needed for installing libraries from the Library
+	// Manager or from zip archives, so that simple tests can be run on
+	// machines where it is not installed.
+	specs := append([]string{}, test.Sketches[b.sketch].Libraries...)
+	if test.PackageType == Library {
+		depends, err := libraryDepends(test.PackagePath)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, depends...)
+	}
+	for _, spec := range specs {
+		if kind, _, _ := parseLibrarySpec(spec); kind == libraryManager || kind == libraryZip {
+			if err := b.setup(); err != nil {
+				return err
+			}
+			if err := b.installLibraries(); err != nil {
+				return err
+			}
+			return b.finish()
+		}
+	}
+
+	if b.cliDir, err = ioutil.TempDir("/tmp", ".cino-native"); err != nil {
+		return err
+	}
+	if err := b.installLibraries(); err != nil {
+		return err
+	}
+	b.cinoLibDir, err = writeCinoH(b.cliDir)
+	return err
+}
+
+// Compile builds the sketch with the host compiler. As with the Arduino
+// builder, the .ino files are concatenated, but no function prototypes are
+// generated, so functions must be declared before being used.
+func (b *native) Compile(flags string) (string, error) {
+	if len(b.buildProperties()) > 0 {
+		return "", fmt.Errorf("build properties are not supported on native devices")
+	}
+	for _, d := range b.defines() {
+		flags += " -D" + d
+	}
+	sketchPath := b.sketchPath()
+	librariesDir := filepath.Join(b.cliDir, "user/libraries")
+	key, err := buildKey(b.device.FQBN, "", flags, sketchPath, librariesDir)
+	if err != nil {
+		return "", err
+	}
+	buildID := "cino" + key
+
+	// Write the shim and the main sketch file
+	buildDir := filepath.Join(b.cliDir, "build")
+	coreDir := filepath.Join(buildDir, "core")
+	if err := os.MkdirAll(coreDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	for name, src := range nativeShim {
+		if err := ioutil.WriteFile(filepath.Join(coreDir, name), []byte(src), 0644); err != nil {
+			return "", err
+		}
+	}
+	inos, _ := filepath.Glob(filepath.Join(sketchPath, "*.ino"))
+	main := "#include <Arduino.h>\n"
+	for _, ino := range inos {
+		src, err := ioutil.ReadFile(ino)
+		if err != nil {
+			return "", err
+		}
+		main += fmt.Sprintf("#line 1 %q\n%s\n", ino, src)
+	}
+	mainFile := filepath.Join(buildDir, filepath.Base(sketchPath)+".ino.cpp")
+	if err := ioutil.WriteFile(mainFile, []byte(main), 0644); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"-std=gnu++11", "-Wno-write-strings", "-DARDUINO=10813", "-DCINO_NATIVE"},
+		strings.Fields(flags)...)
+	args = append(args, "-DCINO_BUILD_ID="+buildID,
+		"-I", coreDir, "-I", filepath.Join(b.cinoLibDir, "src"), "-I", sketchPath)
+	sources := []string{filepath.Join(coreDir, "Arduino.cpp"), mainFile}
+	sources = append(sources, nativeSources(sketchPath, false)...)
+	sources = append(sources, nativeSources(filepath.Join(sketchPath, "src"), true)...)
+	libs, _ := ioutil.ReadDir(librariesDir)
+	for _, lib := range libs {
+		dir := filepath.Join(librariesDir, lib.Name())
+		if _, err := os.Stat(filepath.Join(dir, "src")); err == nil {
+			args = append(args, "-I", filepath.Join(dir, "src"))
+			sources = append(sources, nativeSources(filepath.Join(dir, "src"), true)...)
+		} else {
+			// Legacy layout, with sources in the root and in utility
+			args = append(args, "-I", dir)
+			sources = append(sources, nativeSources(dir, false)...)
+			sources = append(sources, nativeSources(filepath.Join(dir, "utility"), false)...)
+		}
+	}
+
+	b.exe = filepath.Join(buildDir, filepath.Base(sketchPath))
+	compiler := os.Getenv("CXX")
+	if compiler == "" {
+		compiler = "c++"
+	}
+	cmd := exec.Command(compiler, append(append(args, sources...), "-o", b.exe)...)
+	if err := b.run(cmd); err != nil {
+		return "", buildError{err.Error()}
+	}
+	return buildID, nil
+}
+
+func (b *native) Artifacts() Artifacts {
+	return Artifacts{
+		BuildDir: filepath.Dir(b.exe),
+		Bin:      b.exe,
+		Elf:      b.exe,
+	}
+}
+
+func (b *native) UploadCommand() (*exec.Cmd, error) {
+	return nil, fmt.Errorf("native devices do not need uploading")
+}
+
+// nativeSources returns the C and C++ source files in dir, looking into its
+// subdirectories if recursive is true.
+func nativeSources(dir string, recursive bool) (out []string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && (!recursive || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".c", ".cpp", ".cc":
+			out = append(out, path)
+		}
+		return nil
+	})
+	return out
+}
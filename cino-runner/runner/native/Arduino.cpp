@@ -0,0 +1,191 @@
+// Implementation of the Arduino API shim declared in Arduino.h, along with
+// the main() function calling setup() and loop().
+
+#include "Arduino.h"
+
+#include <ctype.h>
+#include <stdarg.h>
+#include <strings.h>
+#include <time.h>
+
+HardwareSerial Serial;
+
+static struct timespec start;
+
+static unsigned long long elapsedMicros()
+{
+    struct timespec now;
+    clock_gettime(CLOCK_MONOTONIC, &now);
+    return (now.tv_sec - start.tv_sec) * 1000000ULL + (now.tv_nsec - start.tv_nsec) / 1000;
+}
+
+unsigned long millis() { return elapsedMicros() / 1000; }
+unsigned long micros() { return elapsedMicros(); }
+
+void delay(unsigned long ms)
+{
+    struct timespec ts = {(time_t)(ms / 1000), (long)(ms % 1000) * 1000000L};
+    nanosleep(&ts, NULL);
+}
+
+void delayMicroseconds(unsigned int us)
+{
+    struct timespec ts = {(time_t)(us / 1000000), (long)(us % 1000000) * 1000L};
+    nanosleep(&ts, NULL);
+}
+
+void yield() {}
+
+void pinMode(uint8_t, uint8_t) {}
+void digitalWrite(uint8_t, uint8_t) {}
+int digitalRead(uint8_t) { return LOW; }
+int analogRead(uint8_t) { return 0; }
+void analogWrite(uint8_t, int) {}
+
+long random(long max) { return max > 0 ? rand() % max : 0; }
+long random(long min, long max) { return min >= max ? min : min + random(max - min); }
+void randomSeed(unsigned long seed) { srand(seed); }
+
+long map(long x, long in_min, long in_max, long out_min, long out_max)
+{
+    return (x - in_min) * (out_max - out_min) / (in_max - in_min) + out_min;
+}
+
+// String
+
+static std::string formatNumber(unsigned long n, unsigned char base, bool negative)
+{
+    if (base < 2)
+        base = 10;
+    std::string out;
+    do
+    {
+        int digit = n % base;
+        out.insert(out.begin(), digit < 10 ? '0' + digit : 'A' + digit - 10);
+        n /= base;
+    } while (n > 0);
+    if (negative)
+        out.insert(out.begin(), '-');
+    return out;
+}
+
+static std::string formatSigned(long n, unsigned char base)
+{
+    if (n < 0 && base == DEC)
+        return formatNumber(-(unsigned long)n, base, true);
+    return formatNumber((unsigned long)n, base, false);
+}
+
+static std::string formatFloat(double n, unsigned char digits)
+{
+    char buf[64];
+    snprintf(buf, sizeof(buf), "%.*f", digits, n);
+    return buf;
+}
+
+String::String(int n, unsigned char base) : s(formatSigned(n, base)) {}
+String::String(unsigned int n, unsigned char base) : s(formatNumber(n, base, false)) {}
+String::String(long n, unsigned char base) : s(formatSigned(n, base)) {}
+String::String(unsigned long n, unsigned char base) : s(formatNumber(n, base, false)) {}
+String::String(double n, unsigned char decimals) : s(formatFloat(n, decimals)) {}
+
+bool String::equalsIgnoreCase(const String &o) const
+{
+    return s.length() == o.s.length() && strcasecmp(s.c_str(), o.s.c_str()) == 0;
+}
+
+String String::substring(unsigned int from, unsigned int to) const
+{
+    if (from > to)
+        std::swap(from, to);
+    if (from >= s.length())
+        return String();
+    return String(s.substr(from, to - from));
+}
+
+void String::replace(const String &from, const String &to)
+{
+    if (from.s.empty())
+        return;
+    for (size_t pos = s.find(from.s); pos != std::string::npos; pos = s.find(from.s, pos + to.s.length()))
+        s.replace(pos, from.s.length(), to.s);
+}
+
+void String::toLowerCase()
+{
+    for (size_t i = 0; i < s.length(); i++)
+        s[i] = tolower(s[i]);
+}
+
+void String::toUpperCase()
+{
+    for (size_t i = 0; i < s.length(); i++)
+        s[i] = toupper(s[i]);
+}
+
+void String::trim()
+{
+    size_t begin = s.find_first_not_of(" \t\r\n");
+    size_t end = s.find_last_not_of(" \t\r\n");
+    s = begin == std::string::npos ? "" : s.substr(begin, end - begin + 1);
+}
+
+String operator+(const String &a, const String &b)
+{
+    String out(a);
+    out += b;
+    return out;
+}
+
+String operator+(const String &a, const char *b) { return a + String(b); }
+String operator+(const char *a, const String &b) { return String(a) + b; }
+String operator+(const String &a, char b) { return a + String(b); }
+String operator+(const String &a, int b) { return a + String(b); }
+String operator+(const String &a, unsigned int b) { return a + String(b); }
+String operator+(const String &a, long b) { return a + String(b); }
+String operator+(const String &a, unsigned long b) { return a + String(b); }
+String operator+(const String &a, double b) { return a + String(b); }
+
+// Print
+
+size_t Print::write(const uint8_t *buf, size_t size)
+{
+    size_t n = 0;
+    while (size--)
+        n += write(*buf++);
+    return n;
+}
+
+size_t Print::print(long n, int base) { return print(String(n, base)); }
+size_t Print::print(unsigned long n, int base) { return print(String(n, base)); }
+size_t Print::print(double n, int digits) { return print(String(n, digits)); }
+
+size_t Print::printf(const char *format, ...)
+{
+    char buf[256];
+    va_list args;
+    va_start(args, format);
+    vsnprintf(buf, sizeof(buf), format, args);
+    va_end(args);
+    return print(buf);
+}
+
+size_t HardwareSerial::write(uint8_t c)
+{
+    return fwrite(&c, 1, 1, stdout);
+}
+
+size_t HardwareSerial::write(const uint8_t *buf, size_t size)
+{
+    return fwrite(buf, 1, size, stdout);
+}
+
+int main()
+{
+    // Lines are read by cino-runner as soon as they are printed.
+    setvbuf(stdout, NULL, _IOLBF, 0);
+    clock_gettime(CLOCK_MONOTONIC, &start);
+    setup();
+    while (true)
+        loop();
+}
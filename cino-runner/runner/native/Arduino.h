@@ -0,0 +1,246 @@
+// Minimal implementation of the Arduino API for running test sketches on the
+// host. Only what is needed by cino.h and by sketches testing pure logic is
+// provided: serial output goes to the standard output, while I/O functions do
+// nothing.
+
+#ifndef Arduino_h
+#define Arduino_h
+
+#include <math.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <algorithm>
+#include <string>
+
+using std::max;
+using std::min;
+
+typedef uint8_t byte;
+typedef bool boolean;
+typedef unsigned int word;
+
+#define HIGH 0x1
+#define LOW 0x0
+#define INPUT 0x0
+#define OUTPUT 0x1
+#define INPUT_PULLUP 0x2
+#define LED_BUILTIN 13
+
+#define DEC 10
+#define HEX 16
+#define OCT 8
+#define BIN 2
+
+#define SERIAL_5N1 0x00
+#define SERIAL_6N1 0x02
+#define SERIAL_7N1 0x04
+#define SERIAL_8N1 0x06
+#define SERIAL_5N2 0x08
+#define SERIAL_6N2 0x0A
+#define SERIAL_7N2 0x0C
+#define SERIAL_8N2 0x0E
+#define SERIAL_5E1 0x20
+#define SERIAL_6E1 0x22
+#define SERIAL_7E1 0x24
+#define SERIAL_8E1 0x26
+#define SERIAL_5E2 0x28
+#define SERIAL_6E2 0x2A
+#define SERIAL_7E2 0x2C
+#define SERIAL_8E2 0x2E
+#define SERIAL_5O1 0x30
+#define SERIAL_6O1 0x32
+#define SERIAL_7O1 0x34
+#define SERIAL_8O1 0x36
+#define SERIAL_5O2 0x38
+#define SERIAL_6O2 0x3A
+#define SERIAL_7O2 0x3C
+#define SERIAL_8O2 0x3E
+
+#define PROGMEM
+#define PSTR(s) (s)
+#define pgm_read_byte(addr) (*(const uint8_t *)(addr))
+#define pgm_read_word(addr) (*(const uint16_t *)(addr))
+
+#define constrain(amt, low, high) ((amt) < (low) ? (low) : ((amt) > (high) ? (high) : (amt)))
+#define sq(x) ((x) * (x))
+#define bit(b) (1UL << (b))
+#define bitRead(value, bit) (((value) >> (bit)) & 0x01)
+#define bitSet(value, bit) ((value) |= (1UL << (bit)))
+#define bitClear(value, bit) ((value) &= ~(1UL << (bit)))
+#define bitWrite(value, bit, bitvalue) ((bitvalue) ? bitSet(value, bit) : bitClear(value, bit))
+#define lowByte(w) ((uint8_t)((w)&0xff))
+#define highByte(w) ((uint8_t)((w) >> 8))
+
+class __FlashStringHelper;
+#define F(s) (reinterpret_cast<const __FlashStringHelper *>(s))
+
+unsigned long millis();
+unsigned long micros();
+void delay(unsigned long ms);
+void delayMicroseconds(unsigned int us);
+void yield();
+
+void pinMode(uint8_t pin, uint8_t mode);
+void digitalWrite(uint8_t pin, uint8_t val);
+int digitalRead(uint8_t pin);
+int analogRead(uint8_t pin);
+void analogWrite(uint8_t pin, int val);
+
+long random(long max);
+long random(long min, long max);
+void randomSeed(unsigned long seed);
+long map(long x, long in_min, long in_max, long out_min, long out_max);
+
+class String
+{
+public:
+    String(const char *s = "") : s(s ? s : "") {}
+    String(const std::string &s) : s(s) {}
+    String(const __FlashStringHelper *s) : s(reinterpret_cast<const char *>(s)) {}
+    explicit String(char c) : s(1, c) {}
+    explicit String(int n, unsigned char base = DEC);
+    explicit String(unsigned int n, unsigned char base = DEC);
+    explicit String(long n, unsigned char base = DEC);
+    explicit String(unsigned long n, unsigned char base = DEC);
+    explicit String(double n, unsigned char decimals = 2);
+
+    const char *c_str() const { return s.c_str(); }
+    unsigned int length() const { return s.length(); }
+    char charAt(unsigned int i) const { return i < s.length() ? s[i] : 0; }
+    char operator[](unsigned int i) const { return charAt(i); }
+    char &operator[](unsigned int i) { return s[i]; }
+
+    String &operator+=(const String &o)
+    {
+        s += o.s;
+        return *this;
+    }
+    String &operator+=(const char *o)
+    {
+        s += o;
+        return *this;
+    }
+    String &operator+=(char c)
+    {
+        s += c;
+        return *this;
+    }
+    String &operator+=(int n) { return *this += String(n); }
+    String &operator+=(unsigned int n) { return *this += String(n); }
+    String &operator+=(long n) { return *this += String(n); }
+    String &operator+=(unsigned long n) { return *this += String(n); }
+    String &operator+=(double n) { return *this += String(n); }
+    bool concat(const String &o)
+    {
+        s += o.s;
+        return true;
+    }
+
+    bool operator==(const String &o) const { return s == o.s; }
+    bool operator!=(const String &o) const { return s != o.s; }
+    bool operator<(const String &o) const { return s < o.s; }
+    bool equals(const String &o) const { return s == o.s; }
+    bool equalsIgnoreCase(const String &o) const;
+    bool startsWith(const String &o) const { return s.compare(0, o.s.length(), o.s) == 0; }
+    bool endsWith(const String &o) const
+    {
+        return s.length() >= o.s.length() && s.compare(s.length() - o.s.length(), o.s.length(), o.s) == 0;
+    }
+
+    int indexOf(char c, unsigned int from = 0) const { return find(s.find(c, from)); }
+    int indexOf(const String &o, unsigned int from = 0) const { return find(s.find(o.s, from)); }
+    int lastIndexOf(char c) const { return find(s.rfind(c)); }
+    int lastIndexOf(const String &o) const { return find(s.rfind(o.s)); }
+    String substring(unsigned int from) const { return from < s.length() ? String(s.substr(from)) : String(); }
+    String substring(unsigned int from, unsigned int to) const;
+
+    void replace(char from, char to) { std::replace(s.begin(), s.end(), from, to); }
+    void replace(const String &from, const String &to);
+    void remove(unsigned int index) { s.erase(std::min<size_t>(index, s.length())); }
+    void remove(unsigned int index, unsigned int count) { s.erase(std::min<size_t>(index, s.length()), count); }
+    void toLowerCase();
+    void toUpperCase();
+    void trim();
+
+    long toInt() const { return atol(s.c_str()); }
+    float toFloat() const { return atof(s.c_str()); }
+    double toDouble() const { return atof(s.c_str()); }
+
+private:
+    static int find(size_t pos) { return pos == std::string::npos ? -1 : (int)pos; }
+    std::string s;
+};
+
+String operator+(const String &a, const String &b);
+String operator+(const String &a, const char *b);
+String operator+(const char *a, const String &b);
+String operator+(const String &a, char b);
+String operator+(const String &a, int b);
+String operator+(const String &a, unsigned int b);
+String operator+(const String &a, long b);
+String operator+(const String &a, unsigned long b);
+String operator+(const String &a, double b);
+
+class Print
+{
+public:
+    virtual ~Print() {}
+    virtual size_t write(uint8_t c) = 0;
+    virtual size_t write(const uint8_t *buf, size_t size);
+    size_t write(const char *s) { return write((const uint8_t *)s, strlen(s)); }
+
+    size_t print(const __FlashStringHelper *s) { return print(reinterpret_cast<const char *>(s)); }
+    size_t print(const String &s) { return write((const uint8_t *)s.c_str(), s.length()); }
+    size_t print(const char *s) { return write(s); }
+    size_t print(char c) { return write((uint8_t)c); }
+    size_t print(unsigned char n, int base = DEC) { return print((unsigned long)n, base); }
+    size_t print(int n, int base = DEC) { return print((long)n, base); }
+    size_t print(unsigned int n, int base = DEC) { return print((unsigned long)n, base); }
+    size_t print(long n, int base = DEC);
+    size_t print(unsigned long n, int base = DEC);
+    size_t print(double n, int digits = 2);
+
+    size_t println() { return write("\r\n"); }
+    template <typename T>
+    size_t println(const T &value) { return print(value) + println(); }
+    template <typename T>
+    size_t println(const T &value, int format) { return print(value, format) + println(); }
+
+    size_t printf(const char *format, ...);
+};
+
+class Stream : public Print
+{
+public:
+    virtual int available() = 0;
+    virtual int read() = 0;
+    virtual int peek() = 0;
+    void setTimeout(unsigned long) {}
+};
+
+// HardwareSerial writes to the standard output. Nothing is ever received.
+class HardwareSerial : public Stream
+{
+public:
+    void begin(unsigned long) {}
+    void begin(unsigned long, uint8_t) {}
+    void end() {}
+    int available() { return 0; }
+    int read() { return -1; }
+    int peek() { return -1; }
+    void flush() { fflush(stdout); }
+    size_t write(uint8_t c);
+    size_t write(const uint8_t *buf, size_t size);
+    using Print::write;
+    operator bool() { return true; }
+};
+
+extern HardwareSerial Serial;
+
+void setup();
+void loop();
+
+#endif
@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alranel/cino/lib"
+)
+
+func TestNativeShimUpToDate(t *testing.T) {
+	for _, name := range []string{"Arduino.h", "Arduino.cpp"} {
+		src, err := ioutil.ReadFile("native/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(src) != nativeShim[name] {
+			t.Errorf("nativeshim.go is out of date with native/%s; run go generate", name)
+		}
+	}
+}
+
+func TestRunTestNative(t *testing.T) {
+	if _, err := exec.LookPath("c++"); err != nil {
+		t.Skip("no C++ compiler available")
+	}
+	Config.Devices = []Device{{Kind: KindNative, FQBN: NativeFQBN}}
+
+	tests, err := FindTests("../../examples/04_logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := AssignDevices(tests[0].GetRequirements())
+	if len(devices) != 1 || !devices[0].IsVirtual() {
+		t.Fatalf("Wrong devices returned: %v", devices)
+	}
+	if err := RunTest(&tests[0], devices, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tests[0].Status != "success" {
+		t.Errorf("Test failed:\n%s", tests[0].Log)
+	}
+}
+
+func TestRunTestInSketch(t *testing.T) {
+	if _, err := exec.LookPath("c++"); err != nil {
+		t.Skip("no C++ compiler available")
+	}
+	tests := []struct {
+		name     string
+		duration string
+		sketch   string
+		status   string
+		output   string
+	}{
+		{
+			// Assertions are collected until the duration elapses
+			"deadline", "1s",
+			"void setup() {}\nvoid loop() { CHECK(millis() >= 0); delay(100); }\n",
+			"success", "",
+		},
+		{
+			// The sketch exiting before the deadline completes the test
+			"exit", "30s",
+			"void setup() { CHECK(1 + 1 == 2); exit(0); }\nvoid loop() {}\n",
+			"success", "",
+		},
+		{
+			"failure", "30s",
+			"void setup() { CHECK(1 + 1 == 3); exit(0); }\nvoid loop() {}\n",
+			"failure", "FAIL",
+		},
+		{
+			"no assertions", "30s",
+			"void setup() { if (millis() > 1000000) CHECK(false); exit(0); }\nvoid loop() {}\n",
+			"failure", "Error: no assertions were executed",
+		},
+	}
+	for _, tt := range tests {
+		// The main .ino file is not named after the directory, as with
+		// application sketches at the root of a cloned repository.
+		dir := writeTestDir(t, map[string]string{
+			"cino.yml": "duration: " + tt.duration + "\n",
+			"app.ino":  "#include <cino.h>\n" + tt.sketch,
+		})
+		defer os.RemoveAll(dir)
+		found, err := FindTests(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found[0].InSketch {
+			t.Fatalf("%s: not detected as in-sketch test", tt.name)
+		}
+		start := time.Now()
+		if err := RunTest(&found[0], []Device{{Kind: KindNative, FQBN: NativeFQBN}}, nil); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if found[0].Status != tt.status || !strings.Contains(found[0].Output, tt.output) {
+			t.Errorf("%s: got status %s, expected %s:\n%s", tt.name, found[0].Status, tt.status, found[0].Log)
+		}
+		if elapsed := time.Since(start); (tt.duration == "1s" && elapsed < time.Second) || elapsed > 20*time.Second {
+			t.Errorf("%s: test run for %s", tt.name, elapsed)
+		}
+	}
+}
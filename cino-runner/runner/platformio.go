@@ -0,0 +1,153 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/alranel/cino/lib"
+	"github.com/otiai10/copy"
+)
+
+// platformIO builds sketches contained in PlatformIO projects. The FQBN of
+// the device is the name of the environment to be built, as declared in
+// platformio.ini. The project is copied to a temporary directory, where the
+// libraries listed in cino.yml, the library under test and cino.h are added
+// to its lib directory.
+type platformIO struct {
+	*buildEnv
+	projectDir string
+}
+
+// pio returns a pio command acting on the environment of the device.
+func (b *platformIO) pio(args ...string) *exec.Cmd {
+	return exec.Command("pio", append(args, "-d", b.projectDir, "-e", b.device.FQBN)...)
+}
+
+func (b *platformIO) Prepare() (err error) {
+	test := b.test
+	if test.PackageType == Core {
+		return fmt.Errorf("testing cores is not supported in PlatformIO projects")
+	}
+
+	b.projectDir, err = ioutil.TempDir("/tmp", ".platformio")
+	if err != nil {
+		return err
+	}
+	err = copy.Copy(b.sketchPath(), b.projectDir, copy.Options{
+		Skip: func(src string) (bool, error) {
+			return filepath.Base(src) == ".git" || filepath.Base(src) == ".pio", nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	b.output(fmt.Sprintf("Using PlatformIO environment %s\n", b.device.FQBN))
+
+	// Install the required libraries, as declared in the cino.yml file,
+	// honoring the versions recorded in cino.lock.
+	libDir := filepath.Join(b.projectDir, "lib")
+	os.MkdirAll(libDir, os.ModePerm)
+	for _, lib := range test.Sketches[b.sketch].Libraries {
+		kind, location, ref := parseLibrarySpec(lib)
+		switch kind {
+		case libraryManager, libraryZip:
+			spec := lib
+			if name, version := SplitVersion(lib); kind == libraryManager && version == "" && test.Locked[name] != "" {
+				spec = name + "@" + test.Locked[name]
+			} else if kind == libraryZip && !strings.Contains(location, "://") {
+				if spec, err = repoPath(test, location); err != nil {
+					break
+				}
+			}
+			err = b.run(b.pio("pkg", "install", "--library", spec))
+		case libraryGit:
+			b.output(fmt.Sprintf("Installing library from %s\n", lib))
+			_, err = installLibraryGit(location, ref, libDir)
+		case libraryDir:
+			if location, err = repoPath(test, location); err != nil {
+				break
+			}
+			b.output(fmt.Sprintf("Installing library from %s\n", location))
+			_, err = installLibraryDir(location, filepath.Base(location), libDir)
+		}
+		if err != nil {
+			return buildError{fmt.Sprintf("Error installing library: %s\n%s\n", lib, err.Error())}
+		}
+	}
+
+	// Install the library that we want to test. Its dependencies are
+	// resolved by PlatformIO.
+	if test.PackageType == Library {
+		if _, err := installLibraryDir(test.PackagePath, filepath.Base(test.PackagePath), libDir); err != nil {
+			return err
+		}
+	}
+
+	// Add cino.h as a library of the project.
+	cinoDir := filepath.Join(libDir, "cino", "src")
+	if err := os.MkdirAll(cinoDir, os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(cinoDir, "cino.h"), []byte(cinoH), 0644)
+}
+
+// Compile builds the environment, passing the flags through the
+// PLATFORMIO_BUILD_FLAGS variable. PlatformIO keeps its own build cache, so
+// the project is always built.
+func (b *platformIO) Compile(flags string) (string, error) {
+	if len(b.buildProperties()) > 0 {
+		return "", fmt.Errorf("build properties are not supported in PlatformIO projects")
+	}
+	for _, d := range b.defines() {
+		flags += " -D" + d
+	}
+	key, err := buildKey(b.device.FQBN, "", flags, b.projectDir)
+	if err != nil {
+		return "", err
+	}
+	buildID := "cino" + key
+
+	cmd := b.pio("run")
+	cmd.Env = append(os.Environ(), "PLATFORMIO_BUILD_FLAGS="+flags+" -DCINO_BUILD_ID="+buildID)
+	if err := b.run(cmd); err != nil {
+		return "", buildError{err.Error()}
+	}
+	return buildID, nil
+}
+
+func (b *platformIO) Artifacts() Artifacts {
+	buildDir := filepath.Join(b.projectDir, ".pio", "build", b.device.FQBN)
+	return Artifacts{
+		BuildDir: buildDir,
+		Bin:      filepath.Join(buildDir, "firmware.bin"),
+		Hex:      filepath.Join(buildDir, "firmware.hex"),
+		Elf:      filepath.Join(buildDir, "firmware.elf"),
+	}
+}
+
+// UploadCommand returns the command uploading the built environment. The
+// upload protocol is the one configured in platformio.ini.
+func (b *platformIO) UploadCommand() (*exec.Cmd, error) {
+	switch b.device.Upload.Method {
+	case "", "serial":
+		cmd := b.pio("run", "-t", "nobuild", "-t", "upload")
+		if b.device.Port != "" {
+			cmd.Args = append(cmd.Args, "--upload-port", b.device.Port)
+		}
+		return cmd, nil
+	case "command":
+		return customUploadCommand(b.device, b.Artifacts())
+	default:
+		return nil, fmt.Errorf("upload method %s is not supported for PlatformIO devices; set upload_protocol in platformio.ini instead", b.device.Upload.Method)
+	}
+}
+
+func (b *platformIO) Close() {
+	if b.projectDir != "" {
+		os.RemoveAll(b.projectDir)
+	}
+}
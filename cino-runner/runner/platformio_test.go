@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/alranel/cino/lib"
+)
+
+// fakePIO is a shell script standing in for pio, logging its arguments and
+// the build flags, and producing the firmware when building.
+const fakePIO = `#!/bin/sh
+echo "$@" >> "$PIO_LOG"
+case "$1" in
+run)
+	echo "flags $PLATFORMIO_BUILD_FLAGS" >> "$PIO_LOG"
+	while [ $# -gt 1 ]; do
+		case "$1" in
+		-d) dir=$2 ;;
+		-e) env=$2 ;;
+		esac
+		shift
+	done
+	mkdir -p "$dir/.pio/build/$env"
+	touch "$dir/.pio/build/$env/firmware.elf" ;;
+esac
+`
+
+func TestPlatformIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-pio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := filepath.Join(dir, "bin")
+	os.Mkdir(binDir, os.ModePerm)
+	if err := ioutil.WriteFile(filepath.Join(binDir, "pio"), []byte(fakePIO), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	logFile := filepath.Join(dir, "log")
+	defer os.Unsetenv("PIO_LOG")
+	os.Setenv("PIO_LOG", logFile)
+
+	// A PlatformIO library only having library.json, with a test project
+	repo := filepath.Join(dir, "MyLib")
+	for name, content := range map[string]string{
+		"library.json":                  `{"name": "MyLib", "version": "1.0.0"}`,
+		"src/MyLib.h":                   "",
+		"test/cino.yml":                 "sketches:\n  - libraries:\n      - Servo\n      - ./helper\n",
+		"test/platformio.ini":           "[env:uno]\nplatform = atmelavr\nboard = uno\nframework = arduino\n",
+		"test/src/main.cpp":             "#include <cino.h>\n",
+		"test/helper/library.json":      `{"name": "Helper"}`,
+		"test/.pio/build/uno/stale.elf": "",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(repo, name)), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644)
+	}
+	tests, err := FindTests(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 1 || tests[0].PackageType != Library || tests[0].Sketches[0].Backend != BackendPlatformIO {
+		t.Fatalf("wrong tests found: %+v", tests)
+	}
+	tests[0].Locked = map[string]string{"Servo": "1.1.8"}
+
+	device := Device{FQBN: "uno", Backend: BackendPlatformIO, Port: "/dev/ttyACM0"}
+	backend, err := newBackend(&buildEnv{
+		test:       &tests[0],
+		device:     &device,
+		run:        func(cmd *exec.Cmd) error { return cmd.Run() },
+		output:     func(string) {},
+		setVersion: func(string, string) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// The project is copied, without its build directory, and the
+	// libraries are added to it
+	if err := backend.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	projectDir := backend.(*platformIO).projectDir
+	for _, file := range []string{"platformio.ini", "src/main.cpp", "lib/MyLib/library.json",
+		"lib/MyLib/src/MyLib.h", "lib/Helper/library.json", "lib/cino/src/cino.h"} {
+		if _, err := os.Stat(filepath.Join(projectDir, file)); err != nil {
+			t.Errorf("%s missing from project", file)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(projectDir, ".pio")); !os.IsNotExist(err) {
+		t.Errorf(".pio directory copied to project")
+	}
+
+	// The flags are passed in the environment
+	buildID, err := backend.Compile("-DCINO_TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buildID, "cino") {
+		t.Errorf("wrong build ID %s", buildID)
+	}
+	if _, err := os.Stat(backend.Artifacts().Elf); err != nil {
+		t.Errorf("firmware not found: %s", err)
+	}
+	data, _ := ioutil.ReadFile(logFile)
+	expected := strings.Join([]string{
+		"pkg install --library Servo@1.1.8 -d " + projectDir + " -e uno",
+		"run -d " + projectDir + " -e uno",
+		"flags -DCINO_TEST -DCINO_BUILD_ID=" + buildID,
+	}, "\n") + "\n"
+	if string(data) != expected {
+		t.Errorf("got pio commands:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	cmd, err := backend.UploadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedArgs := []string{"pio", "run", "-t", "nobuild", "-t", "upload", "-d", projectDir, "-e", "uno",
+		"--upload-port", "/dev/ttyACM0"}
+	if !reflect.DeepEqual(cmd.Args, expectedArgs) {
+		t.Errorf("got upload command %q, expected %q", cmd.Args, expectedArgs)
+	}
+	device.Upload.Method = "programmer"
+	if _, err := backend.UploadCommand(); err == nil {
+		t.Errorf("expected error for programmer upload method")
+	}
+
+	backend.Close()
+	if _, err := os.Stat(projectDir); !os.IsNotExist(err) {
+		t.Errorf("project directory not removed")
+	}
+}
@@ -0,0 +1,250 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DetectedPort represents a serial port found on this machine.
+type DetectedPort struct {
+	Port         string
+	VID          string // lowercase hex, without 0x
+	PID          string // lowercase hex, without 0x
+	SerialNumber string
+	USBPath      string   // physical USB path, such as 1-1.2 (Linux only)
+	FQBNs        []string // boards recognized by arduino-cli on this port
+}
+
+// VIDPID returns the VID and PID of the port in the vid:pid format.
+func (p *DetectedPort) VIDPID() string {
+	if p.VID == "" {
+		return ""
+	}
+	return p.VID + ":" + p.PID
+}
+
+// DetectPorts lists the USB serial ports available on this machine, merging
+// the information available from sysfs (on Linux) and from arduino-cli.
+// If withBoards is false, arduino-cli is only queried when sysfs is not
+// available.
+func DetectPorts(withBoards bool) ([]DetectedPort, error) {
+	ports := sysfsPorts()
+	if len(ports) > 0 && !withBoards {
+		return ports, nil
+	}
+
+	out, err := exec.Command("arduino-cli", "board", "list", "--format", "json").Output()
+	if err != nil {
+		if len(ports) > 0 {
+			return ports, nil
+		}
+		return nil, fmt.Errorf("arduino-cli board list failed: %w", err)
+	}
+	cliPorts, err := parseBoardList(out)
+	if err != nil {
+		return nil, err
+	}
+
+cli:
+	for _, cp := range cliPorts {
+		for i := range ports {
+			if ports[i].Port == cp.Port {
+				ports[i].FQBNs = cp.FQBNs
+				continue cli
+			}
+		}
+		ports = append(ports, cp)
+	}
+	return ports, nil
+}
+
+// sysfsPorts lists the USB serial ports known to sysfs.
+func sysfsPorts() (out []DetectedPort) {
+	entries, _ := filepath.Glob("/sys/class/tty/*/device")
+	for _, entry := range entries {
+		dir, err := filepath.EvalSymlinks(entry)
+		if err != nil {
+			continue
+		}
+
+		// Walk up the tree until we find the USB device the tty belongs to
+		for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			vid, err := ioutil.ReadFile(filepath.Join(dir, "idVendor"))
+			if err != nil {
+				continue
+			}
+			pid, _ := ioutil.ReadFile(filepath.Join(dir, "idProduct"))
+			serial, _ := ioutil.ReadFile(filepath.Join(dir, "serial"))
+			out = append(out, DetectedPort{
+				Port:         filepath.Join("/dev", filepath.Base(filepath.Dir(entry))),
+				VID:          normalizeUSBID(string(vid)),
+				PID:          normalizeUSBID(string(pid)),
+				SerialNumber: strings.TrimSpace(string(serial)),
+				USBPath:      filepath.Base(dir),
+			})
+			break
+		}
+	}
+	return out
+}
+
+// parseBoardList parses the output of arduino-cli board list --format json.
+// Multiple versions of the format are supported.
+func parseBoardList(data []byte) ([]DetectedPort, error) {
+	type board struct {
+		FQBN string
+	}
+	type cliPort struct {
+		// arduino-cli >= 0.20
+		MatchingBoards []board `json:"matching_boards"`
+		Port           struct {
+			Address    string
+			Properties map[string]string
+		}
+		// arduino-cli < 0.20
+		Address      string
+		Boards       []board
+		SerialNumber string `json:"serial_number"`
+		VID          string
+		PID          string
+	}
+
+	var list []cliPort
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) > 0 && data[0] == '{' {
+		// arduino-cli >= 0.30 wraps the list in an object
+		var wrapper struct {
+			DetectedPorts []cliPort `json:"detected_ports"`
+		}
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return nil, err
+		}
+		list = wrapper.DetectedPorts
+	} else if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	var out []DetectedPort
+	for _, p := range list {
+		dp := DetectedPort{
+			Port:         p.Address,
+			VID:          normalizeUSBID(p.VID),
+			PID:          normalizeUSBID(p.PID),
+			SerialNumber: p.SerialNumber,
+		}
+		if p.Port.Address != "" {
+			dp.Port = p.Port.Address
+			dp.VID = normalizeUSBID(p.Port.Properties["vid"])
+			dp.PID = normalizeUSBID(p.Port.Properties["pid"])
+			dp.SerialNumber = p.Port.Properties["serialNumber"]
+		}
+		for _, b := range append(p.MatchingBoards, p.Boards...) {
+			if b.FQBN != "" {
+				dp.FQBNs = append(dp.FQBNs, b.FQBN)
+			}
+		}
+		if dp.Port != "" {
+			out = append(out, dp)
+		}
+	}
+	return out, nil
+}
+
+func normalizeUSBID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+}
+
+// IsIdentifiedByUSB returns true if the port of the device has to be looked
+// up by its USB properties instead of being configured statically.
+func (d *Device) IsIdentifiedByUSB() bool {
+	return d.SerialNumber != "" || d.VIDPID != "" || d.USBPath != ""
+}
+
+// Matches returns true if the given port satisfies all the USB properties
+// configured for the device.
+func (d *Device) Matches(p *DetectedPort) bool {
+	if !d.IsIdentifiedByUSB() {
+		return d.Port == p.Port
+	}
+	if d.SerialNumber != "" && d.SerialNumber != p.SerialNumber {
+		return false
+	}
+	if d.VIDPID != "" {
+		t := strings.SplitN(d.VIDPID, ":", 2)
+		if len(t) != 2 || normalizeUSBID(t[0]) != p.VID || normalizeUSBID(t[1]) != p.PID {
+			return false
+		}
+	}
+	if d.USBPath != "" && d.USBPath != p.USBPath {
+		return false
+	}
+	return true
+}
+
+// ResolvePort looks up the current port of a device identified by its USB
+// properties and stores it in Port. Nothing is done for other devices.
+func (d *Device) ResolvePort() error {
+	if !d.IsIdentifiedByUSB() {
+		return nil
+	}
+	ports, err := DetectPorts(false)
+	if err != nil {
+		return err
+	}
+	var found []string
+	for i := range ports {
+		if d.Matches(&ports[i]) {
+			found = append(found, ports[i].Port)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no port found for device %s", d)
+	} else if len(found) > 1 {
+		return fmt.Errorf("multiple ports found for device %s: %s", d, strings.Join(found, ", "))
+	}
+	d.Port = found[0]
+	return nil
+}
+
+// String returns a description of the device suitable for messages.
+func (d *Device) String() string {
+	var ids []string
+	if d.SerialNumber != "" {
+		ids = append(ids, "serial number "+d.SerialNumber)
+	}
+	if d.VIDPID != "" {
+		ids = append(ids, "VID:PID "+d.VIDPID)
+	}
+	if d.USBPath != "" {
+		ids = append(ids, "USB path "+d.USBPath)
+	}
+	if len(ids) == 0 {
+		return fmt.Sprintf("%s on %s", d.FQBN, d.Port)
+	}
+	return fmt.Sprintf("%s with %s", d.FQBN, strings.Join(ids, ", "))
+}
+
+// waitForMonitor waits until the monitor port of the device exists. Devices
+// identified by their USB properties are resolved again, as their port may
+// have changed after reset.
+func waitForMonitor(d *Device, timeout time.Duration) error {
+	if !d.IsIdentifiedByUSB() || d.HasSeparateMonitor() {
+		return waitForPort(d.Monitor(), timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := d.ResolvePort()
+		if err == nil {
+			return waitForPort(d.Port, time.Until(deadline))
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBoardList(t *testing.T) {
+	expected := []DetectedPort{
+		{Port: "/dev/ttyACM0", VID: "2341", PID: "0058", SerialNumber: "ABC123", FQBNs: []string{"arduino:avr:nano_every"}},
+		{Port: "/dev/ttyS0"},
+	}
+
+	// arduino-cli >= 0.30
+	ports, err := parseBoardList([]byte(`{"detected_ports":[
+		{"matching_boards":[{"name":"Arduino Nano Every","fqbn":"arduino:avr:nano_every"}],
+		 "port":{"address":"/dev/ttyACM0","protocol":"serial","properties":{"pid":"0x0058","vid":"0x2341","serialNumber":"ABC123"}}},
+		{"port":{"address":"/dev/ttyS0","protocol":"serial"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Wrong ports: %+v", ports)
+	}
+
+	// arduino-cli < 0.20
+	ports, err = parseBoardList([]byte(`[
+		{"address":"/dev/ttyACM0","protocol":"serial","boards":[{"name":"Arduino Nano Every","FQBN":"arduino:avr:nano_every"}],
+		 "serial_number":"ABC123","vid":"0x2341","pid":"0x0058"},
+		{"address":"/dev/ttyS0","protocol":"serial"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Wrong ports: %+v", ports)
+	}
+}
+
+func TestDeviceMatches(t *testing.T) {
+	port := DetectedPort{Port: "/dev/ttyACM1", VID: "2341", PID: "0058", SerialNumber: "ABC123", USBPath: "1-1.2"}
+	if !(&Device{SerialNumber: "ABC123"}).Matches(&port) {
+		t.Error("Device not matched by serial number")
+	}
+	if !(&Device{VIDPID: "0x2341:0x0058", USBPath: "1-1.2"}).Matches(&port) {
+		t.Error("Device not matched by VID:PID and USB path")
+	}
+	if (&Device{VIDPID: "2341:0058", USBPath: "1-1.3"}).Matches(&port) {
+		t.Error("Device matched despite wrong USB path")
+	}
+	if !(&Device{Port: "/dev/ttyACM1"}).Matches(&port) {
+		t.Error("Device not matched by port")
+	}
+}
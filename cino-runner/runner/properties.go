@@ -0,0 +1,42 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+)
+
+const extraFlagsProperty = "compiler.cpp.extra_flags"
+
+// buildProperties returns the --build-property values for compiling a sketch,
+// given the extra flags set by cino-runner and the defines and build properties
+// configured for the device and in cino.yml, in order of precedence. Since
+// the extra flags are passed through a build property too, any value given for
+// it is appended to ours rather than replacing them.
+func buildProperties(extraFlags string, defines []string, properties []string) ([]string, error) {
+	for _, d := range defines {
+		extraFlags += " -D" + d
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	for _, p := range properties {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid build property (expected key=value): %s", p)
+		}
+		if kv[0] == extraFlagsProperty {
+			extraFlags += " " + kv[1]
+			continue
+		}
+		if _, ok := values[kv[0]]; !ok {
+			keys = append(keys, kv[0])
+		}
+		values[kv[0]] = kv[1]
+	}
+
+	out := []string{extraFlagsProperty + "=" + strings.TrimSpace(extraFlags)}
+	for _, k := range keys {
+		out = append(out, k+"="+values[k])
+	}
+	return out, nil
+}
@@ -0,0 +1,26 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildProperties(t *testing.T) {
+	got, err := buildProperties("-DCINO_FQBN=arduino:avr:uno",
+		[]string{"LED_PIN=13", "DEBUG"},
+		[]string{"build.f_cpu=8000000L", "compiler.cpp.extra_flags=-Os", "build.f_cpu=16000000L"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"compiler.cpp.extra_flags=-DCINO_FQBN=arduino:avr:uno -DLED_PIN=13 -DDEBUG -Os",
+		"build.f_cpu=16000000L",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+
+	if _, err := buildProperties("", nil, []string{"build.f_cpu"}); err == nil {
+		t.Errorf("expected error for invalid property")
+	}
+}
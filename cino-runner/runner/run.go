@@ -14,11 +14,12 @@ import (
 	"time"
 
 	. "github.com/alranel/cino/lib"
-	"github.com/otiai10/copy"
 	"go.bug.st/serial"
-	"gopkg.in/ini.v1"
 )
 
+// portTimeout is how long to wait for a port to reappear after a board reset.
+const portTimeout = 30 * time.Second
+
 // testMsg represents a message coming from a board running a test sketch,
 // encoded as a single-line JSON object.
 type testMsg struct {
@@ -29,10 +30,27 @@ type testMsg struct {
 	Line   int
 	Fatal  bool
 	Done   bool
+	Skip   string
+	Log    string
+
+	// Hello message
+	Version int
+	FQBN    string
+	Core    string
+	Build   string
+}
+
+// outputLine is a chunk of text to be appended to the test output. Private
+// lines only end up in the full log of the test, while public ones also go
+// in the output that can be shown in reports.
+type outputLine struct {
+	s       string
+	private bool
 }
 
-// Run runs a test package on the given board
-func RunTest(test *Test, devices []Device) error {
+// RunTest runs a test package on the given boards. The job is only used for
+// passing information to hooks and can be nil.
+func RunTest(test *Test, devices []Device, job *Job) (err error) {
 	// Make sure things are consistent.
 	if len(devices) != len(test.Sketches) {
 		return fmt.Errorf("number of assigned devices (%d) does not match the number of sketches defined in test (%d)",
@@ -40,33 +58,46 @@ func RunTest(test *Test, devices []Device) error {
 	}
 
 	// Prepare utilities for log generation
-	outputChan := make(chan string)
+	outputChan := make(chan outputLine)
 	done := make(chan bool)
-	appendOutput := func(sketchIdx int, s string) {
+	appendLine := func(sketchIdx int, s string, private bool) {
 		if len(test.Sketches) > 1 && sketchIdx > -1 {
 			s = fmt.Sprintf("[%s] %s", test.Sketches[sketchIdx].Dir, s)
 		}
-		outputChan <- s
+		outputChan <- outputLine{s, private}
+	}
+	appendOutput := func(sketchIdx int, s string) {
+		appendLine(sketchIdx, s, false)
+	}
+	appendLog := func(sketchIdx int, s string) {
+		appendLine(sketchIdx, s, true)
 	}
 	go func() {
 		for {
-			s, more := <-outputChan
+			l, more := <-outputChan
 			if more {
-				fmt.Print(s)
-				test.Output += s
+				fmt.Print(l.s)
+				test.Log += l.s
+				if !l.private {
+					test.Output += l.s
+				}
 			} else {
 				done <- true
 				return
 			}
 		}
 	}()
+	defer func() {
+		// Wait for all output to be written to test.Output
+		close(outputChan)
+		<-done
+	}()
 
 	appendOutput(-1, fmt.Sprintf("Test requires %d devices\n", len(test.Sketches)))
 
-	// Prepare CLI wrapper
-	runCLI := func(i int, args ...string) error {
-		appendOutput(i, fmt.Sprintf("arduino-cli %s\n", strings.Join(args, " ")))
-		cmd := exec.Command("arduino-cli", args...)
+	// Prepare command wrappers
+	runCmd := func(i int, cmd *exec.Cmd) error {
+		appendOutput(i, fmt.Sprintf("%s\n", strings.Join(cmd.Args, " ")))
 		if out, err := cmd.CombinedOutput(); err != nil {
 			appendOutput(i, fmt.Sprintf("%s", out))
 			return err
@@ -74,168 +105,258 @@ func RunTest(test *Test, devices []Device) error {
 		return nil
 	}
 
+	// Prepare hooks wrapper. The output of hooks only goes to the full log,
+	// which is not published for untrusted repositories, as it may contain
+	// details about the lab setup.
+	runHook := func(i int, name string, hook string, env ...string) error {
+		cmd := hookCommand(hook, append(hookEnv(&devices[i], i, test, job), env...))
+		if cmd == nil {
+			return nil
+		}
+		appendLog(i, fmt.Sprintf("Running %s hook: %s\n", name, hook))
+		out, err := cmd.CombinedOutput()
+		appendLog(i, fmt.Sprintf("%s", out))
+		if err != nil {
+			appendOutput(i, fmt.Sprintf("Error: %s hook failed: %s\n", name, err))
+		}
+		return err
+	}
+
+	// Run the after_test hooks when done, preceded by the on_error hooks if
+	// something went wrong with the device.
+	deviceErrors := make([]bool, len(devices))
+	defer func() {
+		for i := range devices {
+			if err != nil || deviceErrors[i] {
+				runHook(i, "on_error", devices[i].Hooks.OnError, "CINO_ERROR=1")
+			}
+			runHook(i, "after_test", devices[i].Hooks.AfterTest, "CINO_TEST_STATUS="+test.Status)
+		}
+	}()
+
 	// Compile sketches and upload
+	cache := DefaultCache()
 	var wg sync.WaitGroup
+	test.Versions = make(map[string]string)
+	var versionsMutex sync.Mutex
+	setVersion := func(name, version string) {
+		versionsMutex.Lock()
+		test.Versions[name] = version
+		versionsMutex.Unlock()
+	}
 	errs := make(chan error, len(test.Sketches))
 	success := true
-	for i, sketch := range test.Sketches {
+	failBuild := func(i int, err error) {
+		// Build errors make the test fail, while other errors are ours
+		if e, ok := err.(buildError); ok {
+			appendOutput(i, e.msg)
+			success = false
+		} else {
+			errs <- err
+		}
+	}
+	buildIDs := make([]string, len(test.Sketches))
+	coreVersions := make([]string, len(test.Sketches))
+	assertionTables := make([]assertionTable, len(test.Sketches))
+	serialModes := make([]*serial.Mode, len(test.Sketches))
+	serialPorts := make([]io.ReadCloser, len(test.Sketches))
+	closeSerialPorts := func() {
+		for _, p := range serialPorts {
+			if p != nil {
+				p.Close()
+			}
+		}
+	}
+	// Backends are kept until the end, as virtual devices run the sketch
+	// from the build directory.
+	backends := make([]Backend, len(test.Sketches))
+	defer func() {
+		for _, b := range backends {
+			if b != nil {
+				b.Close()
+			}
+		}
+	}()
+	for i := range test.Sketches {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
+			sketch := test.Sketches[i]
 			device := &devices[i]
-			appendOutput(i, fmt.Sprintf("Device %d: %s on %s\n", i, device.FQBN, device.Port))
-			test.DeviceFQBNs = append(test.DeviceFQBNs, device.FQBN)
-
-			// Check if device exists
-			if _, err := os.Stat(device.Port); os.IsNotExist(err) {
-				errs <- fmt.Errorf(("Error: device %s does not exist\n"), device.Port)
+			if err := device.ResolvePort(); err != nil {
+				errs <- err
 				return
 			}
+			if device.IsVirtual() {
+				appendOutput(i, fmt.Sprintf("Device %d: %s (%s)\n", i, device.FQBN, device.Kind))
+			} else if device.HasSeparateMonitor() {
+				appendOutput(i, fmt.Sprintf("Device %d: %s on %s (monitor on %s)\n", i, device.FQBN, device.Port, device.MonitorPort))
+			} else {
+				appendOutput(i, fmt.Sprintf("Device %d: %s on %s\n", i, device.FQBN, device.Port))
+			}
+			test.DeviceFQBNs = append(test.DeviceFQBNs, device.FQBN)
 
-			// Prepare a vanilla arduino-cli environment
-			var cliDir, cliConfigFile string
-			var err error
-			defer os.RemoveAll(cliDir)
-			{
-				cliDir, err = ioutil.TempDir("/tmp", ".arduino-cli")
-				if err != nil {
-					errs <- err
+			// Check if device exists
+			for _, port := range device.Ports() {
+				if _, err := os.Stat(port); os.IsNotExist(err) {
+					errs <- fmt.Errorf(("Error: device %s does not exist\n"), port)
 					return
 				}
-
-				cliConfigFile = filepath.Join(cliDir, "config.yml")
-				cmds := [][]string{
-					{"config", "init", "--dest-file", cliConfigFile},
-					{"--config-file", cliConfigFile, "config", "set", "directories.data", filepath.Join(cliDir, "data")},
-					{"--config-file", cliConfigFile, "config", "set", "directories.downloads", filepath.Join(cliDir, "downloads")},
-					{"--config-file", cliConfigFile, "config", "set", "directories.user", filepath.Join(cliDir, "user")},
-					{"--config-file", cliConfigFile, "config", "set", "library.enable_unsafe_install", "true"},
-					{"--config-file", cliConfigFile, "update"},
-				}
-				for _, cmd := range cmds {
-					if err := runCLI(i, cmd...); err != nil {
-						errs <- err
-						return
-					}
-				}
 			}
 
-			// Install the needed core.
-			if idx := strings.LastIndex(device.FQBN, ":"); idx != -1 {
-				core := device.FQBN[:idx]
-				if err := runCLI(i, "--config-file", cliConfigFile, "core", "install", core); err != nil {
-					errs <- err
-					return
-				}
+			if err := runHook(i, "before_test", device.Hooks.BeforeTest); err != nil {
+				errs <- err
+				return
 			}
 
-			// Install the required libraries, as declared in the cino.yml file.
-			for _, lib := range sketch.Libraries {
-				if err := runCLI(i, "--config-file", cliConfigFile, "lib", "install", lib); err != nil {
-					appendOutput(i, fmt.Sprintf("Error installing library: %s\n%s\n", lib, err.Error()))
-					// Do not stop the process; it will probably fail during compilation
-					return
-				}
+			// Prepare the build environment
+			backend, err := newBackend(&buildEnv{
+				test:       test,
+				sketch:     i,
+				device:     device,
+				cache:      cache,
+				run:        func(cmd *exec.Cmd) error { return runCmd(i, cmd) },
+				output:     func(s string) { appendOutput(i, s) },
+				setVersion: setVersion,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			backends[i] = backend
+			if err := backend.Prepare(); err != nil {
+				failBuild(i, err)
+				return
 			}
 
-			if test.PackageType == Library {
-				// Install the library that we want to test
-				/*
-					// This does not work because of arduino-cli bug: https://github.com/arduino/arduino-cli/issues/1120
-					if err := runCLI(i, "--config-file", cliConfigFile, "lib", "install", "--git-url", test.PackagePath); err != nil {
-						errs <- err
-						return
-					}
-				*/
+			// Determine the serial settings
+			serialModes[i], err = serialMode(sketch.BaudRate, sketch.SerialConfig, device)
+			if err != nil {
+				errs <- err
+				return
+			}
 
-				f, err := ini.Load(filepath.Join(test.PackagePath, "library.properties"))
+			// Compile, passing the information that the sketch will report back
+			// in its hello message so that we can verify what runs on the board.
+			sketchPath := filepath.Join(test.Path, sketch.Dir)
+			extraFlags := fmt.Sprintf("-DCINO_TEST -DCINO_FQBN=%s %s",
+				BoardFQBN(device.FQBN), serialDefines(serialModes[i]))
+			if device.MonitorSerial != "" {
+				extraFlags += " -DCINO_SERIAL=" + device.MonitorSerial
+			}
+			if sketch.Protocol == "compact" {
+				// Build the table for decoding the compact records
+				assertionTables[i], err = scanAssertions(sketchPath)
 				if err != nil {
 					errs <- err
 					return
 				}
-				libDir := filepath.Join(cliDir, "user/libraries", f.Section("").Key("name").String())
-				os.Mkdir(libDir, os.ModePerm)
-				err = copy.Copy(test.PackagePath, libDir)
+				extraFlags += " -DCINO_COMPACT"
+			}
+			if buildIDs[i], err = backend.Compile(extraFlags); err != nil {
+				failBuild(i, err)
+				return
+			}
+			versionsMutex.Lock()
+			coreVersions[i] = test.Versions[coreID(device.FQBN)]
+			versionsMutex.Unlock()
+			if device.IsVirtual() {
+				// Nothing to upload, the sketch is run later
+				return
+			}
+
+			// When the output comes from a separate port, the board will not wait for
+			// us to connect after upload, so we need to start listening beforehand.
+			if device.HasSeparateMonitor() {
+				appendOutput(i, fmt.Sprintf("Connecting to %s\n", device.MonitorPort))
+				port, err := serial.Open(device.MonitorPort, serialModes[i])
 				if err != nil {
 					errs <- err
 					return
 				}
+				port.ResetInputBuffer()
+				serialPorts[i] = port
 			}
 
-			if test.PackageType == Core {
-				// TODO: arduino-cli does not provide a way to install a core from a local path
+			// Upload
+			if err := runHook(i, "before_upload", device.Hooks.BeforeUpload); err != nil {
+				errs <- err
+				return
 			}
-
-			// Write cino.h to a temporary file so that we can include it during compilation.
-			// This can be removed when cino is available through the Library Manager.
-			cinoLibDir, err := writeCinoH(test.Path)
-			if err != nil {
+			if err := device.ResolvePort(); err != nil {
 				errs <- err
 				return
 			}
-			defer os.RemoveAll(cinoLibDir)
-
-			// Compile
-			sketchPath := filepath.Join(test.Path, sketch.Dir)
-			err = runCLI(i,
-				"--config-file", cliConfigFile,
-				"compile",
-				"-b", device.FQBN,
-				"--libraries", cinoLibDir,
-				sketchPath)
+			uploadCmd, err := backend.UploadCommand()
 			if err != nil {
-				appendOutput(i, err.Error())
-				success = false
+				errs <- err
 				return
 			}
-
-			// Upload
-			err = runCLI(i,
-				"--config-file", cliConfigFile,
-				"upload",
-				"-b", device.FQBN,
-				"-p", device.Port,
-				sketchPath)
+			err = runCmd(i, uploadCmd)
 			if err != nil {
 				errs <- err
 				return
 			}
+			if err := runHook(i, "after_upload", device.Hooks.AfterUpload); err != nil {
+				errs <- err
+				return
+			}
 		}(i)
 	}
 	wg.Wait()
 
 	select {
 	case err := <-errs:
+		closeSerialPorts()
 		return err
 	default:
 	}
 
 	if success == false {
-		test.Status = "failure"
+		closeSerialPorts()
+		setStatus(test, "failure", appendOutput)
 		return nil
 	}
 
 	// Connect to the boards
-	serialPorts := make([]serial.Port, len(test.Sketches))
 	for i := range test.Sketches {
-		appendOutput(i, fmt.Sprintf("Connecting to %s\n", devices[i].Port))
-
-		// Wait until port exists (it may be temporarily unavailable because of board reset)
-		for {
-			if _, err := os.Stat(devices[i].Port); !os.IsNotExist(err) {
-				break
+		if serialPorts[i] != nil {
+			// Already connected before upload
+			continue
+		}
+		if devices[i].IsVirtual() {
+			cmd, err := runCommand(&devices[i], backends[i].Artifacts())
+			if err != nil {
+				closeSerialPorts()
+				return err
 			}
-			time.Sleep(100 * time.Millisecond)
+			appendOutput(i, fmt.Sprintf("Running %s\n", strings.Join(cmd.Args, " ")))
+			port, err := startProcess(cmd)
+			if err != nil {
+				closeSerialPorts()
+				return err
+			}
+			serialPorts[i] = port
+			continue
+		}
+		// Wait until port exists (it may be temporarily unavailable because of board reset)
+		if err := waitForMonitor(&devices[i], portTimeout); err != nil {
+			closeSerialPorts()
+			return err
 		}
 
+		port := devices[i].Monitor()
+		appendOutput(i, fmt.Sprintf("Connecting to %s\n", port))
 		var err error
-		serialPorts[i], err = serial.Open(devices[i].Port, &serial.Mode{BaudRate: 9600})
+		serialPorts[i], err = serial.Open(port, serialModes[i])
 		if err != nil {
+			closeSerialPorts()
 			return err
 		}
 	}
 
 	// Parse output coming from the boards
+	sketchStatus := make([]string, len(test.Sketches))
 	for i := range test.Sketches {
 		wg.Add(1)
 		go func(i int) {
@@ -243,82 +364,179 @@ func RunTest(test *Test, devices []Device) error {
 			serialPort := serialPorts[i]
 			defer serialPort.Close()
 
+			parser, err := newFrameworkParser(test.Sketches[i].Framework)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			helloReceived := false
 			testPlanDeclared := false
+			skipped := false
+			completed := false
 			plannedTests := -1
 			totalTests := 0
 			failedTests := 0
+			// In-sketch tests run with no plan, so we collect results until
+			// the configured duration elapses.
+			deadline := time.Now().Add(test.RunDuration())
 			r := bufio.NewReaderSize(serialPort, 256)
+		read:
 			for {
-				rawLine, err := readln(r, 5*time.Second)
+				timeout := 5 * time.Second
+				if test.InSketch {
+					timeout = time.Until(deadline)
+				}
+				rawLine, err := readln(r, timeout)
 				if err == io.EOF {
+					if test.InSketch {
+						completed = true
+					}
 					break
 				} else if err != nil {
 					errs <- err
 					return
 				}
-
-				// Skip non-JSON lines
-				if rawLine[0] != '{' {
-					continue
+				if devices[i].IsVirtual() {
+					rawLine = stripEscapes(rawLine)
 				}
 
-				// Parse line
-				var line testMsg
-				err = json.Unmarshal(rawLine, &line)
-				if err != nil {
-					errs <- err
-					return
-				}
-
-				// Read message
-				if line.Plan > 0 {
-					// Line is a test plan declaration
-					if testPlanDeclared == true {
-						appendOutput(i, "Error: duplicate TEST_PLAN() directive\n")
-						break
+				// Keep non-JSON lines in the full log only
+				var msgs []testMsg
+				if parser != nil {
+					// Translate the output of another test framework
+					if msgs = parser.parse(string(rawLine)); len(msgs) == 0 {
+						appendLog(i, fmt.Sprintf("SERIAL: %s", rawLine))
+						continue
 					}
-					testPlanDeclared = true
-					plannedTests = line.Plan
-				} else if line.Expr != "" {
-					// Line is a test result
-					if testPlanDeclared == false {
-						// A test was run before the test plan was declared
-						appendOutput(i, "Error: no test plan declared\n")
-						break
+				} else if rawLine[0] == '#' && assertionTables[i] != nil {
+					// Decode compact record
+					msg, err := assertionTables[i].decode(string(rawLine))
+					if err != nil {
+						errs <- err
+						return
 					}
-
-					totalTests++
-					if line.Result == true {
-						appendOutput(i, fmt.Sprintf("PASS: %s:%d: %s\n", line.File, line.Line, line.Expr))
-					} else {
-						appendOutput(i, fmt.Sprintf("FAIL: %s:%d: %s\n", line.File, line.Line, line.Expr))
-						failedTests++
+					msgs = []testMsg{*msg}
+				} else if rawLine[0] != '{' {
+					appendLog(i, fmt.Sprintf("SERIAL: %s", rawLine))
+					continue
+				} else {
+					// Parse line
+					var line testMsg
+					err = json.Unmarshal(rawLine, &line)
+					if err != nil {
+						errs <- err
+						return
 					}
+					msgs = []testMsg{line}
 				}
 
-				if line.Done || line.Fatal {
-					break
+				for _, line := range msgs {
+					// Read message
+					if line.Version > 0 {
+						// Line is the hello message
+						if err := checkHello(&line, devices[i].FQBN, coreVersions[i], buildIDs[i]); err != nil {
+							appendOutput(i, fmt.Sprintf("Error: %s\n", err.Error()))
+							failedTests++
+							break read
+						}
+						helloReceived = true
+					} else if line.Log != "" {
+						// Line is a free-form log message
+						appendLog(i, fmt.Sprintf("LOG: %s\n", line.Log))
+					} else if line.Skip != "" {
+						// The sketch decided to skip itself
+						appendOutput(i, fmt.Sprintf("SKIP: %s\n", line.Skip))
+						skipped = true
+						break read
+					} else if line.Plan != 0 {
+						// Line is a test plan declaration
+						if testPlanDeclared == true {
+							appendOutput(i, "Error: duplicate TEST_PLAN() directive\n")
+							break read
+						}
+						if helloReceived == false && parser == nil {
+							appendOutput(i, "Warning: no hello message received, cannot verify the sketch running on the board\n")
+						}
+						testPlanDeclared = true
+						plannedTests = line.Plan
+					} else if line.Expr != "" {
+						// Line is a test result
+						if testPlanDeclared == false && !test.InSketch {
+							// A test was run before the test plan was declared
+							appendOutput(i, "Error: no test plan declared\n")
+							break read
+						}
+
+						// Test cases of other frameworks may have no location
+						location := ""
+						if line.File != "" {
+							location = fmt.Sprintf("%s:%d: ", line.File, line.Line)
+						}
+						totalTests++
+						if line.Result == true {
+							appendOutput(i, fmt.Sprintf("PASS: %s%s\n", location, line.Expr))
+						} else {
+							appendOutput(i, fmt.Sprintf("FAIL: %s%s\n", location, line.Expr))
+							failedTests++
+						}
+					}
+
+					if line.Done || line.Fatal {
+						completed = true
+						break read
+					}
 				}
 			}
 
 			// Check the test results
-			if plannedTests != -1 && plannedTests != totalTests {
-				appendOutput(i, fmt.Sprintf("Error: expected %d tests but run %d\n", plannedTests, totalTests))
-			}
-
-			if failedTests > 0 {
-				test.Status = "failure"
+			if skipped {
+				sketchStatus[i] = "skipped"
 			} else {
-				test.Status = "success"
+				// A board not completing its test plan has likely hung
+				if test.InSketch {
+					if totalTests == 0 {
+						appendOutput(i, "Error: no assertions were executed\n")
+						deviceErrors[i] = true
+					}
+				} else if testPlanDeclared == false {
+					appendOutput(i, "Error: no test plan received from the board\n")
+					deviceErrors[i] = true
+				} else if plannedTests != -1 && plannedTests != totalTests {
+					appendOutput(i, fmt.Sprintf("Error: expected %d tests but run %d\n", plannedTests, totalTests))
+					deviceErrors[i] = true
+				} else if plannedTests == -1 && completed == false {
+					appendOutput(i, "Error: TEST_DONE() was not received\n")
+					deviceErrors[i] = true
+				}
+
+				if failedTests > 0 || deviceErrors[i] {
+					sketchStatus[i] = "failure"
+				} else {
+					sketchStatus[i] = "success"
+				}
 			}
 
-			appendOutput(i, "Test result: "+test.Status+"\n")
+			appendOutput(i, "Test result: "+sketchStatus[i]+"\n")
 		}(i)
 	}
 
 	// Wait for all threads to finish
 	wg.Wait()
 
+	// A single failing sketch makes the whole test fail, while a single
+	// skipping sketch makes it skipped.
+	status := "success"
+	for _, s := range sketchStatus {
+		if s == "failure" {
+			status = "failure"
+			break
+		} else if s == "skipped" {
+			status = "skipped"
+		}
+	}
+	setStatus(test, status, appendOutput)
+
 	// Check if threads emitted errors
 	select {
 	case err := <-errs:
@@ -326,13 +544,64 @@ func RunTest(test *Test, devices []Device) error {
 	default:
 	}
 
-	// Wait for all output to be written to test.Output
-	close(outputChan)
-	<-done
+	return nil
+}
+
+// coreID returns the vendor:architecture identifier of the core providing the
+// board with the given FQBN, or an empty string if the FQBN is not complete.
+func coreID(fqbn string) string {
+	if t := strings.SplitN(fqbn, ":", 3); len(t) == 3 {
+		return t[0] + ":" + t[1]
+	}
+	return ""
+}
 
+// checkHello validates the hello message sent by a board against the sketch
+// that was just compiled and uploaded to it, which was built with the given
+// core version.
+func checkHello(msg *testMsg, fqbn, coreVersion, buildID string) error {
+	if msg.Version != ProtocolVersion {
+		return fmt.Errorf("protocol version mismatch: board speaks version %d, runner expects version %d",
+			msg.Version, ProtocolVersion)
+	}
+	if msg.FQBN != "" && msg.FQBN != BoardFQBN(fqbn) {
+		return fmt.Errorf("sketch running on the board was compiled for %s instead of %s",
+			msg.FQBN, BoardFQBN(fqbn))
+	}
+	if msg.Core != "" && msg.Core != coreVersion {
+		return fmt.Errorf("sketch running on the board was compiled with core version %s instead of %s",
+			msg.Core, coreVersion)
+	}
+	if msg.Build != buildID {
+		return fmt.Errorf("sketch running on the board (build %q) is not the one just uploaded (build %q)",
+			msg.Build, buildID)
+	}
 	return nil
 }
 
+// setStatus stores the final status of the test, turning failures into
+// expected failures (and passes into unexpected passes) if the test declares
+// an xfail entry for any of the boards it was run on.
+func setStatus(test *Test, status string, appendOutput func(int, string)) {
+	if x := test.ExpectedFailure(test.DeviceFQBNs); x != nil {
+		reason := x.Reason
+		if reason == "" {
+			reason = "known failure"
+		}
+		if status == "failure" {
+			status = "xfail"
+			appendOutput(-1, fmt.Sprintf("Failure was expected (%s)\n", reason))
+		} else if status == "success" {
+			status = "xpass"
+			appendOutput(-1, fmt.Sprintf("Test passed but was expected to fail (%s)\n", reason))
+		}
+	}
+	test.Status = status
+}
+
+//go:generate go run gen_cinoh.go
+
+// writeCinoH writes cino.h to a temporary library directory and returns its path.
 func writeCinoH(dir string) (string, error) {
 	cinoLibDir, err := ioutil.TempDir(dir, ".cino")
 	if err != nil {
@@ -341,57 +610,25 @@ func writeCinoH(dir string) (string, error) {
 
 	os.Mkdir(filepath.Join(cinoLibDir, "src"), os.ModePerm)
 
-	cinoh := []byte(`
-#ifndef CINO_H
-#define CINO_H
-
-#define TEST_PLAN(n)            \
-Serial.begin(9600);         \
-while (!Serial) {} \
-Serial.print("{\"plan\":"); \
-Serial.print(n);            \
-Serial.println("}")
-
-#define TEST_NOPLAN() TEST_PLAN(-1)
-
-#define TEST_DONE() \
-Serial.println("{\"done\":true}")
-
-void _cino_check(bool result, char *quoted_expr, char *file, int line, bool fatal)
-{
-Serial.print("{\"result\":");
-Serial.print(result ? "true" : "false");
-Serial.print(",\"expr\":");
-Serial.print(quoted_expr);
-Serial.print(",\"file\":\"");
-String f(file);
-f.replace("\"", "");
-Serial.print(f.substring(f.lastIndexOf('/')+1));
-Serial.print("\",\"line\":");
-Serial.print(line);
-if (!result)
-{
-  Serial.print(",\"fatal\":");
-  Serial.print(fatal ? "true" : "false");
-}
-Serial.println("}");
-if (fatal && !result)
-  while (1)
-  {
-  }
-}
-
-#define _quote(x) #x
-#define REQUIRE(expr) _cino_check((expr), _quote(#expr), __FILE__, __LINE__, 1)
-#define CHECK(expr) _cino_check((expr), _quote(#expr), __FILE__, __LINE__, 0)
-
-#endif
-	`)
-	ioutil.WriteFile(filepath.Join(cinoLibDir, "src", "cino.h"), cinoh, 0644)
+	ioutil.WriteFile(filepath.Join(cinoLibDir, "src", "cino.h"), []byte(cinoH), 0644)
 
 	return cinoLibDir, nil
 }
 
+// waitForPort waits until the given port exists.
+func waitForPort(port string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(port); !os.IsNotExist(err) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port %s did not appear within %s", port, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func readln(reader *bufio.Reader, timeout time.Duration) ([]byte, error) {
 	s := make(chan []byte)
 	e := make(chan error)
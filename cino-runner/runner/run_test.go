@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"testing"
+
+	. "github.com/alranel/cino/lib"
+)
+
+func TestSetStatus(t *testing.T) {
+	xfail := []Xfail{
+		{FQBN: "arduino:avr:uno", Reason: "Wire.setClock() is not honored"},
+		{Architecture: "samd"},
+		{FQBN: "arduino:avr:nano:cpu=atmega328old"},
+	}
+	tests := []struct {
+		fqbns    []string
+		status   string
+		expected string
+	}{
+		{[]string{"arduino:avr:uno"}, "failure", "xfail"},
+		{[]string{"arduino:avr:uno"}, "success", "xpass"},
+		{[]string{"arduino:avr:uno"}, "skipped", "skipped"},
+		{[]string{"arduino:samd:mkr1000"}, "failure", "xfail"},
+		{[]string{"arduino:samd:mkr1000"}, "success", "xpass"},
+		{[]string{"arduino:avr:mega"}, "failure", "failure"},
+		{[]string{"arduino:avr:mega"}, "success", "success"},
+		{[]string{"arduino:avr:mega", "arduino:avr:uno"}, "failure", "xfail"},
+		{[]string{"arduino:avr:uno:cpu=atmega328old"}, "failure", "xfail"},
+		{[]string{"arduino:avr:nano:cpu=atmega328old"}, "failure", "xfail"},
+		{[]string{"arduino:avr:nano"}, "failure", "failure"},
+		{nil, "success", "success"},
+	}
+	for _, tt := range tests {
+		test := &Test{DeviceFQBNs: tt.fqbns}
+		test.Xfail = xfail
+		output := ""
+		setStatus(test, tt.status, func(i int, s string) { output += s })
+		if test.Status != tt.expected {
+			t.Errorf("%v, %s: got %s, expected %s", tt.fqbns, tt.status, test.Status, tt.expected)
+		}
+		if (tt.status != tt.expected) != (output != "") {
+			t.Errorf("%v, %s: unexpected output %q", tt.fqbns, tt.status, output)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"go.bug.st/serial"
+)
+
+const defaultBaudRate = 9600
+
+var serialConfigRe = regexp.MustCompile(`^([5-8])([NEO])([12])$`)
+
+// serialMode returns the serial settings to use for talking to a sketch.
+// Settings declared by the test take precedence over the device ones.
+// The config string follows the Arduino notation, such as 8N1 or 7E2.
+func serialMode(testBaudRate int, testConfig string, device *Device) (*serial.Mode, error) {
+	mode := &serial.Mode{
+		BaudRate: defaultBaudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	if testBaudRate > 0 {
+		mode.BaudRate = testBaudRate
+	} else if device.BaudRate > 0 {
+		mode.BaudRate = device.BaudRate
+	}
+
+	config := testConfig
+	if config == "" {
+		config = device.SerialConfig
+	}
+	if config != "" {
+		res := serialConfigRe.FindStringSubmatch(config)
+		if res == nil {
+			return nil, fmt.Errorf("invalid serial config: %s", config)
+		}
+		mode.DataBits, _ = strconv.Atoi(res[1])
+		mode.Parity = map[string]serial.Parity{
+			"N": serial.NoParity,
+			"E": serial.EvenParity,
+			"O": serial.OddParity,
+		}[res[2]]
+		if res[3] == "2" {
+			mode.StopBits = serial.TwoStopBits
+		}
+	}
+	return mode, nil
+}
+
+// serialDefines returns the compiler flags passing the serial settings to cino.h.
+func serialDefines(mode *serial.Mode) string {
+	out := fmt.Sprintf("-DCINO_BAUD_RATE=%d", mode.BaudRate)
+	if mode.DataBits != 8 || mode.Parity != serial.NoParity || mode.StopBits != serial.OneStopBit {
+		parity := map[serial.Parity]string{
+			serial.NoParity:   "N",
+			serial.EvenParity: "E",
+			serial.OddParity:  "O",
+		}[mode.Parity]
+		stopBits := 1
+		if mode.StopBits == serial.TwoStopBits {
+			stopBits = 2
+		}
+		out += fmt.Sprintf(" -DCINO_SERIAL_CONFIG=SERIAL_%d%s%d", mode.DataBits, parity, stopBits)
+	}
+	return out
+}
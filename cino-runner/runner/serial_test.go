@@ -0,0 +1,61 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+func TestSerialMode(t *testing.T) {
+	tests := []struct {
+		baudRate int
+		config   string
+		device   Device
+		expected *serial.Mode
+		defines  string
+	}{
+		{
+			0, "", Device{},
+			&serial.Mode{BaudRate: 9600, DataBits: 8, Parity: serial.NoParity, StopBits: serial.OneStopBit},
+			"-DCINO_BAUD_RATE=9600",
+		},
+		{
+			0, "", Device{BaudRate: 57600, SerialConfig: "7E1"},
+			&serial.Mode{BaudRate: 57600, DataBits: 7, Parity: serial.EvenParity, StopBits: serial.OneStopBit},
+			"-DCINO_BAUD_RATE=57600 -DCINO_SERIAL_CONFIG=SERIAL_7E1",
+		},
+		{
+			115200, "8O2", Device{BaudRate: 57600, SerialConfig: "7E1"},
+			&serial.Mode{BaudRate: 115200, DataBits: 8, Parity: serial.OddParity, StopBits: serial.TwoStopBits},
+			"-DCINO_BAUD_RATE=115200 -DCINO_SERIAL_CONFIG=SERIAL_8O2",
+		},
+		{
+			0, "8N1", Device{SerialConfig: "5N2"},
+			&serial.Mode{BaudRate: 9600, DataBits: 8, Parity: serial.NoParity, StopBits: serial.OneStopBit},
+			"-DCINO_BAUD_RATE=9600",
+		},
+	}
+	for _, tt := range tests {
+		mode, err := serialMode(tt.baudRate, tt.config, &tt.device)
+		if err != nil {
+			t.Errorf("%d %s: %s", tt.baudRate, tt.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(mode, tt.expected) {
+			t.Errorf("%d %s: got %+v, expected %+v", tt.baudRate, tt.config, mode, tt.expected)
+		}
+		if defines := serialDefines(mode); defines != tt.defines {
+			t.Errorf("%d %s: got defines %q, expected %q", tt.baudRate, tt.config, defines, tt.defines)
+		}
+	}
+
+	for _, config := range []string{"8N", "9N1", "4N1", "8X1", "8N3", "8n1", " 8N1", "8N1 "} {
+		if _, err := serialMode(0, config, &Device{}); err == nil {
+			t.Errorf("expected error for serial config %q", config)
+		}
+		if _, err := serialMode(0, "", &Device{SerialConfig: config}); err == nil {
+			t.Errorf("expected error for device serial config %q", config)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// UploadConfig describes how sketches are uploaded to a device.
+type UploadConfig struct {
+	Method     string // serial (default), programmer or command
+	Programmer string // programmer ID as listed by arduino-cli upload --programmer list
+	Command    string // command template, used with the command method
+}
+
+// uploadCommand returns the arduino-cli command uploading the given build to
+// the device. If the sketch was compiled using a sketch.yaml profile, the
+// same profile is used for finding the upload tools.
+func uploadCommand(device *Device, cliConfigFile, sketchPath string, artifacts Artifacts, profile string) (*exec.Cmd, error) {
+	var profileArgs []string
+	if profile != "" {
+		profileArgs = []string{"--profile", profile}
+	}
+	switch device.Upload.Method {
+	case "", "serial":
+		args := []string{
+			"--config-file", cliConfigFile,
+			"upload",
+			"-b", device.FQBN,
+			"-p", device.Port,
+			"--input-dir", artifacts.BuildDir,
+		}
+		return exec.Command("arduino-cli", append(append(args, profileArgs...), sketchPath)...), nil
+	case "programmer":
+		if device.Upload.Programmer == "" {
+			return nil, fmt.Errorf("no programmer configured for device %s", device.FQBN)
+		}
+		args := []string{
+			"--config-file", cliConfigFile,
+			"upload",
+			"-b", device.FQBN,
+			"--programmer", device.Upload.Programmer,
+			"--input-dir", artifacts.BuildDir,
+		}
+		if device.Port != "" {
+			args = append(args, "-p", device.Port)
+		}
+		return exec.Command("arduino-cli", append(append(args, profileArgs...), sketchPath)...), nil
+	case "command":
+		return customUploadCommand(device, artifacts)
+	default:
+		return nil, fmt.Errorf("unknown upload method: %s", device.Upload.Method)
+	}
+}
+
+// shellQuote quotes a string so that it is passed as a single argument by sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUploadCommand(t *testing.T) {
+	artifacts := Artifacts{
+		BuildDir: "/tmp/build",
+		Bin:      "/tmp/build/blink.ino.bin",
+		Hex:      "/tmp/build/blink.ino.hex",
+		Elf:      "/tmp/build/blink.ino.elf",
+	}
+	tests := []struct {
+		device   Device
+		profile  string
+		expected []string
+	}{
+		{
+			Device{FQBN: "arduino:avr:uno", Port: "/dev/ttyACM0"},
+			"",
+			[]string{"arduino-cli", "--config-file", "cli.yaml", "upload", "-b", "arduino:avr:uno", "-p", "/dev/ttyACM0",
+				"--input-dir", "/tmp/build", "/tmp/blink"},
+		},
+		{
+			Device{FQBN: "arduino:avr:uno", Port: "/dev/ttyACM0", Upload: UploadConfig{Method: "serial"}},
+			"uno",
+			[]string{"arduino-cli", "--config-file", "cli.yaml", "upload", "-b", "arduino:avr:uno", "-p", "/dev/ttyACM0",
+				"--input-dir", "/tmp/build", "--profile", "uno", "/tmp/blink"},
+		},
+		{
+			// The port is optional when uploading with a programmer
+			Device{FQBN: "arduino:samd:mkrzero", Upload: UploadConfig{Method: "programmer", Programmer: "atmel_ice"}},
+			"",
+			[]string{"arduino-cli", "--config-file", "cli.yaml", "upload", "-b", "arduino:samd:mkrzero",
+				"--programmer", "atmel_ice", "--input-dir", "/tmp/build", "/tmp/blink"},
+		},
+		{
+			Device{FQBN: "arduino:samd:mkrzero", Port: "/dev/ttyACM1", Upload: UploadConfig{Method: "programmer", Programmer: "atmel_ice"}},
+			"",
+			[]string{"arduino-cli", "--config-file", "cli.yaml", "upload", "-b", "arduino:samd:mkrzero",
+				"--programmer", "atmel_ice", "--input-dir", "/tmp/build", "-p", "/dev/ttyACM1", "/tmp/blink"},
+		},
+		{
+			Device{FQBN: "arduino:mbed:nano33ble", Port: "/dev/ttyACM0", Upload: UploadConfig{
+				Method:  "command",
+				Command: "openocd -c \"program {elf} verify reset exit\" && echo {bin} {hex} {build_dir} {port} {fqbn}",
+			}},
+			"",
+			[]string{"sh", "-c", "openocd -c \"program '/tmp/build/blink.ino.elf' verify reset exit\" && " +
+				"echo '/tmp/build/blink.ino.bin' '/tmp/build/blink.ino.hex' '/tmp/build' '/dev/ttyACM0' 'arduino:mbed:nano33ble'"},
+		},
+	}
+	for _, tt := range tests {
+		cmd, err := uploadCommand(&tt.device, "cli.yaml", "/tmp/blink", artifacts, tt.profile)
+		if err != nil {
+			t.Errorf("%s %s: %s", tt.device.FQBN, tt.device.Upload.Method, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd.Args, tt.expected) {
+			t.Errorf("%s %s: got %q, expected %q", tt.device.FQBN, tt.device.Upload.Method, cmd.Args, tt.expected)
+		}
+	}
+
+	for _, upload := range []UploadConfig{
+		{Method: "programmer"},
+		{Method: "command"},
+		{Method: "jtag"},
+	} {
+		device := Device{FQBN: "arduino:avr:uno", Upload: upload}
+		if _, err := uploadCommand(&device, "cli.yaml", "/tmp/blink", artifacts, ""); err == nil {
+			t.Errorf("%s: expected error", upload.Method)
+		}
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	device := Device{FQBN: "arduino:avr:uno", Port: "/dev/it's here"}
+	artifacts := Artifacts{BuildDir: "/tmp/my build", Elf: "/tmp/my build/a.elf"}
+	got := expandCommand("flash {elf} {port} {build_dir} {bin} {unknown}", &device, artifacts)
+	expected := `flash '/tmp/my build/a.elf' '/dev/it'\''s here' '/tmp/my build' '' {unknown}`
+	if got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,120 @@
+package runner
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// latestPlatformVersion returns the latest version of the given core (such as
+// arduino:avr) available in the package indexes found in dataDir, or an empty
+// string if the core is not listed.
+func latestPlatformVersion(dataDir, core string) (string, error) {
+	releases, err := indexedPlatforms(dataDir)
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, r := range releases {
+		if r.ID == core && compareVersions(r.Version, latest) > 0 {
+			latest = r.Version
+		}
+	}
+	return latest, nil
+}
+
+// compareVersions compares two dotted version numbers, returning -1, 0 or 1.
+// Pre-release versions (such as 1.0.0-beta) sort before the release.
+func compareVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if b == "" {
+		return 1
+	}
+	if a == "" {
+		return -1
+	}
+	aMain, aPre := splitPrerelease(a)
+	bMain, bPre := splitPrerelease(b)
+	aParts := strings.Split(aMain, ".")
+	bParts := strings.Split(bMain, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	case aPre > bPre:
+		return 1
+	}
+	return -1
+}
+
+func splitPrerelease(v string) (string, string) {
+	if i := strings.IndexAny(v, "-+"); i != -1 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// installedLibraries returns the libraries installed in the user directory of
+// the given arduino-cli configuration, mapped to their versions.
+func installedLibraries(cliConfigFile string) (map[string]string, error) {
+	out, err := exec.Command("arduino-cli", "--config-file", cliConfigFile,
+		"lib", "list", "--format", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseLibList(out)
+}
+
+// parseLibList parses the output of arduino-cli lib list --format json.
+// Multiple versions of the format are supported.
+func parseLibList(data []byte) (map[string]string, error) {
+	type installedLib struct {
+		Library struct {
+			Name    string
+			Version string
+		}
+	}
+	var list []installedLib
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) > 0 && data[0] == '{' {
+		// arduino-cli >= 0.35 wraps the list in an object
+		var wrapper struct {
+			InstalledLibraries []installedLib `json:"installed_libraries"`
+		}
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return nil, err
+		}
+		list = wrapper.InstalledLibraries
+	} else if len(data) > 0 && string(data) != "null" {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]string, len(list))
+	for _, l := range list {
+		out[l.Library.Name] = l.Library.Version
+	}
+	return out, nil
+}
@@ -0,0 +1,42 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.8.3", "1.8.3", 0},
+		{"1.8.10", "1.8.3", 1},
+		{"1.8", "1.8.1", -1},
+		{"2.0.0", "", 1},
+		{"1.0.0-beta", "1.0.0", -1},
+		{"1.0.0-rc2", "1.0.0-rc1", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestParseLibList(t *testing.T) {
+	expected := map[string]string{"Servo": "1.1.8", "Cino": "0.1.0"}
+	tests := map[string]string{
+		"list": `[{"library":{"name":"Servo","version":"1.1.8"}},{"library":{"name":"Cino","version":"0.1.0"}}]`,
+		"wrapped": `{"installed_libraries":[{"library":{"name":"Servo","version":"1.1.8"}},
+			{"library":{"name":"Cino","version":"0.1.0"}}]}`,
+	}
+	for name, data := range tests {
+		got, err := parseLibList([]byte(data))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/alranel/cino/lib"
+)
+
+// Kinds of devices. Boards are physically connected to the runner, while the
+// other kinds run sketches on the host and are thus called virtual.
+const (
+	KindBoard  = "board"
+	KindNative = "native"
+	KindSimavr = "simavr" // AVR boards emulated by simavr
+	KindQEMU   = "qemu"   // ARM boards emulated by QEMU
+)
+
+// EmulatorConfig describes how an emulated device runs sketches.
+type EmulatorConfig struct {
+	MCU       string   // with simavr, the microcontroller, such as atmega328p
+	Frequency int      // with simavr, the clock frequency in Hz
+	Machine   string   // with QEMU, the machine, such as netduinoplus2
+	Args      []string // additional arguments for the emulator
+	Command   string   // command template replacing the default one
+}
+
+// simavrTargets maps the FQBNs of the supported AVR boards to their
+// microcontroller and clock frequency.
+var simavrTargets = map[string]struct {
+	mcu       string
+	frequency int
+}{
+	"arduino:avr:uno":  {"atmega328p", 16000000},
+	"arduino:avr:nano": {"atmega328p", 16000000},
+	"arduino:avr:mini": {"atmega328p", 16000000},
+	"arduino:avr:mega": {"atmega2560", 16000000},
+}
+
+// IsVirtual returns true if the device runs sketches on the host rather than
+// being a board.
+func (d *Device) IsVirtual() bool {
+	return d.Kind != "" && d.Kind != KindBoard
+}
+
+// runCommand returns the command running the sketch built for a virtual
+// device. Its standard output takes the place of the serial port.
+//
+// Command templates are executed by the shell and can contain the same
+// placeholders as upload commands.
+func runCommand(device *Device, artifacts Artifacts) (*exec.Cmd, error) {
+	emulator := &device.Emulator
+	if emulator.Command != "" {
+		return exec.Command("sh", "-c", expandCommand(emulator.Command, device, artifacts)), nil
+	}
+	switch device.Kind {
+	case KindNative:
+		return exec.Command(artifacts.Bin), nil
+	case KindSimavr:
+		mcu, frequency := simavrTarget(device)
+		if mcu == "" {
+			return nil, fmt.Errorf("no microcontroller known for %s, set emulator.mcu", device.FQBN)
+		}
+		args := []string{"-m", mcu}
+		if frequency > 0 {
+			args = append(args, "-f", strconv.Itoa(frequency))
+		}
+		args = append(append(args, emulator.Args...), artifacts.Elf)
+		return exec.Command("simavr", args...), nil
+	case KindQEMU:
+		if emulator.Machine == "" {
+			return nil, fmt.Errorf("no QEMU machine configured for %s, set emulator.machine", device.FQBN)
+		}
+		args := []string{
+			"-machine", emulator.Machine,
+			"-display", "none",
+			"-monitor", "none",
+			"-serial", "stdio",
+		}
+		args = append(append(args, emulator.Args...), "-kernel", artifacts.Elf)
+		return exec.Command("qemu-system-arm", args...), nil
+	default:
+		return nil, fmt.Errorf("unknown device kind: %s", device.Kind)
+	}
+}
+
+// simavrTarget returns the microcontroller and the clock frequency to be
+// emulated by simavr for the device. Unless configured, they are derived from
+// the FQBN, honoring the cpu option of boards offering more than one.
+func simavrTarget(device *Device) (mcu string, frequency int) {
+	target := simavrTargets[BoardFQBN(device.FQBN)]
+	mcu, frequency = target.mcu, target.frequency
+	if t := strings.SplitN(device.FQBN, ":", 4); len(t) == 4 && mcu != "" {
+		for _, option := range strings.Split(t[3], ",") {
+			if cpu := strings.TrimPrefix(option, "cpu="); cpu != option && strings.HasPrefix(cpu, "atmega") {
+				mcu = cpu
+				if strings.HasPrefix(cpu, "atmega328") {
+					// Both the atmega328 and atmega328old options are ATmega328P
+					mcu = "atmega328p"
+				}
+			}
+		}
+	}
+	if device.Emulator.MCU != "" {
+		mcu = device.Emulator.MCU
+	}
+	if device.Emulator.Frequency != 0 {
+		frequency = device.Emulator.Frequency
+	}
+	return mcu, frequency
+}
+
+// processPort reads the output of a process as if it was a serial port.
+// Closing it terminates the process.
+type processPort struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// startProcess starts the given command, returning a port for reading its
+// standard output and standard error, as emulators may print the serial
+// output of the board to either of them.
+func startProcess(cmd *exec.Cmd) (*processPort, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &processPort{r, cmd}, nil
+}
+
+// Close kills the process and closes the pipe. As the process is expected to
+// be still running, being killed is not an error, but any other exit status
+// is returned. Kill only fails if the process has already exited, in which
+// case Wait returns its status.
+func (p *processPort) Close() error {
+	p.cmd.Process.Kill()
+	err := p.cmd.Wait()
+	if status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+		err = nil
+	}
+	if closeErr := p.ReadCloser.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+var escapeRe = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// stripEscapes removes the terminal escape sequences, such as colors, that
+// emulators may add to the output of the board.
+func stripEscapes(line []byte) []byte {
+	return escapeRe.ReplaceAll(line, nil)
+}
@@ -0,0 +1,139 @@
+package runner
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/alranel/cino/lib"
+)
+
+func TestRunCommandEmulators(t *testing.T) {
+	artifacts := Artifacts{Elf: "/tmp/build/test.ino.elf"}
+	tests := []struct {
+		device   Device
+		expected []string
+	}{
+		{
+			Device{Kind: KindSimavr, FQBN: "arduino:avr:uno"},
+			[]string{"simavr", "-m", "atmega328p", "-f", "16000000", "/tmp/build/test.ino.elf"},
+		},
+		{
+			Device{Kind: KindSimavr, FQBN: "arduino:avr:nano:cpu=atmega328old"},
+			[]string{"simavr", "-m", "atmega328p", "-f", "16000000", "/tmp/build/test.ino.elf"},
+		},
+		{
+			Device{Kind: KindSimavr, FQBN: "arduino:avr:mega:cpu=atmega1280"},
+			[]string{"simavr", "-m", "atmega1280", "-f", "16000000", "/tmp/build/test.ino.elf"},
+		},
+		{
+			Device{Kind: KindSimavr, FQBN: "arduino:avr:pro", Emulator: EmulatorConfig{MCU: "atmega328p", Frequency: 8000000}},
+			[]string{"simavr", "-m", "atmega328p", "-f", "8000000", "/tmp/build/test.ino.elf"},
+		},
+		{
+			Device{Kind: KindQEMU, FQBN: "STMicroelectronics:stm32:GenF4", Emulator: EmulatorConfig{Machine: "netduinoplus2", Args: []string{"-icount", "auto"}}},
+			[]string{"qemu-system-arm", "-machine", "netduinoplus2", "-display", "none", "-monitor", "none",
+				"-serial", "stdio", "-icount", "auto", "-kernel", "/tmp/build/test.ino.elf"},
+		},
+		{
+			Device{Kind: KindQEMU, FQBN: "x:y:z", Emulator: EmulatorConfig{Command: "emu {fqbn} {elf}"}},
+			[]string{"sh", "-c", "emu 'x:y:z' '/tmp/build/test.ino.elf'"},
+		},
+	}
+	for _, test := range tests {
+		cmd, err := runCommand(&test.device, artifacts)
+		if err != nil {
+			t.Errorf("%s: %s", test.device.FQBN, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd.Args, test.expected) {
+			t.Errorf("%s: got %q, expected %q", test.device.FQBN, cmd.Args, test.expected)
+		}
+	}
+
+	for _, device := range []Device{
+		{Kind: KindSimavr, FQBN: "arduino:avr:pro"},
+		{Kind: KindQEMU, FQBN: "STMicroelectronics:stm32:GenF4"},
+	} {
+		if _, err := runCommand(&device, artifacts); err == nil {
+			t.Errorf("%s: expected error for unconfigured emulator", device.FQBN)
+		}
+	}
+}
+
+func TestStripEscapes(t *testing.T) {
+	got := string(stripEscapes([]byte("\x1b[32m{\"t\":\"ok\"}\x1b[0m\n")))
+	if got != "{\"t\":\"ok\"}\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestProcessPortClose(t *testing.T) {
+	// Closing a running process kills it and closes the pipe
+	port, err := startProcess(exec.Command("sh", "-c", "echo hello; sleep 10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(port).ReadString('\n'); line != "hello\n" {
+		t.Errorf("got %q", line)
+	}
+	start := time.Now()
+	if err := port.Close(); err != nil {
+		t.Errorf("unexpected error closing running process: %s", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("process not killed")
+	}
+	if _, err := port.Read(make([]byte, 1)); err == nil {
+		t.Errorf("pipe not closed")
+	}
+
+	// The exit status is returned if the process had already exited
+	port, err = startProcess(exec.Command("sh", "-c", "echo bye; exit 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(port)
+	if err := port.Close(); err == nil {
+		t.Errorf("expected exit status error")
+	}
+
+	if port, err := startProcess(exec.Command("/nonexistent/emulator")); err == nil || port != nil {
+		t.Errorf("expected error for missing command")
+	}
+}
+
+func TestRunTestMissingEmulator(t *testing.T) {
+	if _, err := exec.LookPath("simavr"); err == nil {
+		t.Skip("simavr is installed")
+	}
+	defer useFakeCLI(t)()
+	dir := writeTestDir(t, map[string]string{
+		"cino.yml": "sketches:\n  - dir: a\n  - dir: b\n",
+		"a/a.ino":  "void setup() {}\nvoid loop() {}\n",
+		"b/b.ino":  "void setup() {}\nvoid loop() {}\n",
+	})
+	defer os.RemoveAll(dir)
+	tests, err := FindTests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first emulator is started, while the second one is missing: the
+	// first one must be stopped and the error reported.
+	devices := []Device{
+		{Kind: KindSimavr, FQBN: "arduino:avr:uno", Emulator: EmulatorConfig{Command: "sleep 10"}},
+		{Kind: KindSimavr, FQBN: "arduino:avr:uno"},
+	}
+	start := time.Now()
+	if err := RunTest(&tests[0], devices, nil); err == nil {
+		t.Error("expected error for missing emulator")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("first emulator not stopped")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/alranel/cino/lib"
@@ -23,6 +24,7 @@ var Config struct {
 	}
 	Architectures []string
 	Runners       []Runner
+	TrustedRepos  []string `mapstructure:"trusted_repos"`
 	DB            lib.DBConfig
 	GitHub        struct {
 		AppID          int64 `mapstructure:"app_id"`
@@ -63,6 +65,19 @@ func LoadConfig(path string) error {
 	return nil
 }
 
+// IsTrustedRepo returns true if the full log of the tests (including log
+// messages and serial output) can be published for the given repository.
+// Entries in the trusted_repos configuration are matched as "owner/name"
+// glob patterns, such as "arduino-libraries/*".
+func IsTrustedRepo(owner, name string) bool {
+	for _, pattern := range Config.TrustedRepos {
+		if ok, _ := path.Match(pattern, owner+"/"+name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func GitHubClient(installationID int64) *github.Client {
 	// Shared transport to reuse TCP connections.
 	tr := http.DefaultTransport
@@ -0,0 +1,36 @@
+package server
+
+import "testing"
+
+func TestIsTrustedRepo(t *testing.T) {
+	trusted := Config.TrustedRepos
+	defer func() { Config.TrustedRepos = trusted }()
+	Config.TrustedRepos = []string{"arduino-libraries/*", "alranel/cino", "myorg/lib-?"}
+
+	tests := []struct {
+		owner, name string
+		expected    bool
+	}{
+		{"arduino-libraries", "Servo", true},
+		{"arduino-libraries", "ArduinoBLE", true},
+		{"alranel", "cino", true},
+		{"alranel", "cino-fork", false},
+		{"alranel", "other", false},
+		{"myorg", "lib-a", true},
+		{"myorg", "lib-ab", false},
+		// Wildcards do not match across the slash
+		{"arduino-libraries/x", "Servo", false},
+		{"arduino", "libraries", false},
+		{"Arduino-Libraries", "Servo", false},
+	}
+	for _, tt := range tests {
+		if got := IsTrustedRepo(tt.owner, tt.name); got != tt.expected {
+			t.Errorf("%s/%s: got %v, expected %v", tt.owner, tt.name, got, tt.expected)
+		}
+	}
+
+	Config.TrustedRepos = nil
+	if IsTrustedRepo("arduino-libraries", "Servo") {
+		t.Errorf("repository trusted with no trusted_repos")
+	}
+}
@@ -25,7 +25,7 @@ func StartResultsHandler() {
 			var job Job
 			err := tx.Get(&job, `select * from jobs 
 				where (status = 'queued' AND skipped_by_runners @> $1)
-				or (status IN ('success', 'failure', 'in_progress') AND github_status != status)
+				or (status IN ('success', 'failure', 'skipped', 'in_progress') AND github_status != status)
 				order by id for update limit 1`,
 				pq.Array(runnerIDs))
 			if err == sql.ErrNoRows {
@@ -57,7 +57,7 @@ func StartResultsHandler() {
 				checkRunOpts.Status = github.String("completed")
 				checkRunOpts.Conclusion = job.GitHubStatus
 			}
-			if job.Status == "skipped" {
+			if job.Status == "skipped" && len(job.Tests) == 0 {
 				checkRunOpts.Output = new(github.CheckRunOutput)
 				checkRunOpts.Output.Title = github.String("No suitable device")
 				summary := "No suitable runners matching the following features:\n\n"
@@ -81,19 +81,25 @@ func StartResultsHandler() {
 				checkRunOpts.Output = new(github.CheckRunOutput)
 				if job.Status == "success" {
 					checkRunOpts.Output.Title = github.String("All tests passed")
+				} else if job.Status == "skipped" {
+					checkRunOpts.Output.Title = github.String("All tests skipped")
 				} else {
 					checkRunOpts.Output.Title = github.String("Tests failed")
 				}
 				summary := fmt.Sprintf("%d test(s) were run:\n\n", len(job.Tests))
 				for _, t := range job.Tests {
-					summary += fmt.Sprintf("* `%s`\n", t.RelPath())
+					if t.Status == "" {
+						summary += fmt.Sprintf("* `%s`\n", t.RelPath())
+					} else {
+						summary += fmt.Sprintf("* `%s`: %s\n", t.RelPath(), t.Status)
+					}
 				}
 				summary += fmt.Sprintf("\nusing the following board(s) attached to **%s**:\n\n", *job.Runner)
 				for _, d := range job.DeviceFQBNs() {
 					summary += fmt.Sprintf("* %s\n", d)
 				}
 				checkRunOpts.Output.Summary = github.String(summary)
-				checkRunOpts.Output.Text = github.String(job.Report())
+				checkRunOpts.Output.Text = github.String(job.Report(IsTrustedRepo(checkSuite.RepoOwner, checkSuite.RepoName)))
 			}
 			if job.End != nil {
 				checkRunOpts.CompletedAt = &github.Timestamp{Time: *job.End}
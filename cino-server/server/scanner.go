@@ -4,15 +4,11 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"path/filepath"
-	"regexp"
-	"strings"
 
 	. "github.com/alranel/cino/lib"
 	"github.com/google/go-github/github"
 	"github.com/lib/pq"
 	"github.com/thoas/go-funk"
-	"gopkg.in/ini.v1"
 )
 
 // StartScanner listens to a queue containing incoming check_suite notifications
@@ -46,51 +42,8 @@ func StartScanner() {
 				panic(err)
 			}
 
-			// Extract requirements from tests
-			requirements := make([]TestRequirements, 0, len(tests))
-			for _, test := range tests {
-				requirements = append(requirements, test.GetRequirements())
-			}
-
-			var matrix []TestRequirementsMatrix
-			if IsLibrary(repoDir) {
-				// Get all architectures supported by this library.
-				architectures, err := getArchitecturesFromLibrary(repoDir)
-				if err != nil {
-					fmt.Printf("failed to get architectures for library at %s\n", checkSuite.RepoCloneURL)
-					continue
-				}
-				if len(architectures) == 1 && architectures[0] == "*" {
-					// Use the architectures list from our configuration file
-					architectures = Config.Architectures
-				} else if len(Config.Architectures) > 0 {
-					// Limit the list to the ones we have in our configuration file
-					architectures = funk.IntersectString(architectures, Config.Architectures)
-				}
-
-				// Repeat the entire test set for each architecture
-				matrix = RepeatByArchitectures(requirements, architectures)
-			} else if IsCore(repoDir) {
-				// Get all FQBNs supported by this core.
-				fqbns, err := getBoardsFromCore(repoDir)
-				if err != nil {
-					fmt.Printf("failed to get boards for core at %s\n", checkSuite.RepoCloneURL)
-					continue
-				}
-
-				// Repeat the entire test set for each FQBN
-				matrix = RepeatByFQBNs(requirements, fqbns)
-			} else {
-				for _, tr := range requirements {
-					matrix = append(matrix, TestRequirementsMatrix{
-						Original:  tr,
-						Effective: tr,
-					})
-				}
-			}
-
-			// Remove duplicates
-			matrix = uniqRequirements(matrix)
+			// Build the job matrix
+			matrix := buildMatrix(tests)
 
 			// Store jobs and notify runners
 			ctx := context.Background()
@@ -133,29 +86,73 @@ func StartScanner() {
 	})
 }
 
-func getArchitecturesFromLibrary(dir string) ([]string, error) {
-	f, err := ini.Load(filepath.Join(dir, "library.properties"))
-	if err != nil {
-		return nil, err
-	}
-	return strings.Split(f.Section("").Key("architectures").String(), ","), nil
-}
+// buildMatrix returns the requirements of the jobs needed for running the
+// given tests. Each test is repeated according to the package containing it,
+// as a repository may contain multiple libraries or cores: for each
+// architecture supported by a library, or for each board defined by a core.
+func buildMatrix(tests []Test) []TestRequirementsMatrix {
+	var matrix []TestRequirementsMatrix
+	for _, test := range tests {
+		requirements := []TestRequirements{test.GetRequirements()}
+		if usesProfiles(requirements[0]) {
+			// Boards are defined by the sketch.yaml profiles or PlatformIO envs
+			matrix = append(matrix, RepeatByProfiles(requirements[0])...)
+			continue
+		}
+		switch test.PackageType {
+		case Library:
+			// Get all architectures supported by this library.
+			architectures, err := getArchitecturesFromLibrary(test.PackagePath)
+			if err != nil {
+				fmt.Printf("failed to get architectures for library at %s\n", test.PackagePath)
+				continue
+			}
+			if len(architectures) == 1 && architectures[0] == "*" {
+				// Use the architectures list from our configuration file
+				architectures = Config.Architectures
+			} else if len(Config.Architectures) > 0 {
+				// Limit the list to the ones we have in our configuration file
+				architectures = funk.IntersectString(architectures, Config.Architectures)
+			}
 
-func getBoardsFromCore(dir string) ([]string, error) {
-	f, err := ini.Load(filepath.Join(dir, "boards.txt"))
-	if err != nil {
-		return nil, err
-	}
+			// Repeat the test for each architecture
+			matrix = append(matrix, RepeatByArchitectures(requirements, architectures)...)
+		case Core:
+			// Get all FQBNs supported by this core.
+			fqbns, err := getBoardsFromCore(test.PackagePath)
+			if err != nil {
+				fmt.Printf("failed to get boards for core at %s\n", test.PackagePath)
+				continue
+			}
 
-	var out []string
-	re := regexp.MustCompile(`^([^.]+)\.name$`)
-	for _, k := range f.Section("").KeyStrings() {
-		res := re.FindStringSubmatch(k)
-		if len(res) == 2 {
-			out = append(out, res[1])
+			// Board IDs need the vendor and architecture of the core to become
+			// FQBNs; these can be declared in cino.yml.
+			if test.CoreID != "" {
+				for i := range fqbns {
+					fqbns[i] = test.CoreID + ":" + fqbns[i]
+				}
+			}
+
+			// Repeat the test for each FQBN
+			matrix = append(matrix, RepeatByFQBNs(requirements, fqbns)...)
+		default:
+			matrix = append(matrix, TestRequirementsMatrix{
+				Original:  requirements[0],
+				Effective: requirements[0],
+			})
 		}
 	}
-	return out, nil
+
+	// Remove duplicates
+	return uniqRequirements(matrix)
+}
+
+func getArchitecturesFromLibrary(dir string) ([]string, error) {
+	return LibraryArchitectures(dir)
+}
+
+func getBoardsFromCore(dir string) ([]string, error) {
+	return CoreBoards(dir)
 }
 
 func RepeatByArchitectures(tmpl []TestRequirements, architectures []string) []TestRequirementsMatrix {
@@ -198,13 +195,51 @@ func RepeatByFQBNs(tmpl []TestRequirements, fqbns []string) []TestRequirementsMa
 	return out
 }
 
+func usesProfiles(tr TestRequirements) bool {
+	for _, s := range tr.Sketches {
+		if len(s.ProfileFQBNs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RepeatByProfiles repeats the test for each combination of the FQBNs of the
+// sketch.yaml profiles referenced by its sketches.
+func RepeatByProfiles(tr TestRequirements) []TestRequirementsMatrix {
+	combinations := [][]string{{}}
+	for _, s := range tr.Sketches {
+		fqbns := s.ProfileFQBNs
+		if len(fqbns) == 0 || s.RequireFQBN != "" {
+			fqbns = []string{s.RequireFQBN}
+		}
+		var next [][]string
+		for _, c := range combinations {
+			for _, fqbn := range fqbns {
+				next = append(next, append(append([]string{}, c...), fqbn))
+			}
+		}
+		combinations = next
+	}
+
+	out := make([]TestRequirementsMatrix, 0, len(combinations))
+	for _, c := range combinations {
+		r2 := tr.Clone()
+		for j := range r2.Sketches {
+			r2.Sketches[j].RequireFQBN = c[j]
+		}
+		out = append(out, TestRequirementsMatrix{Original: tr, Effective: r2})
+	}
+	return out
+}
+
 func uniqRequirements(tr []TestRequirementsMatrix) []TestRequirementsMatrix {
 	var out []TestRequirementsMatrix
 
 req:
 	for _, r := range tr {
 		for _, r2 := range out {
-			if r.Effective.Equals(r2.Effective) {
+			if r.Effective.Equals(r2.Effective) && r.Original.Equals(r2.Original) {
 				continue req
 			}
 		}
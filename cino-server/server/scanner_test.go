@@ -2,9 +2,12 @@ package server
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"testing"
 
 	. "github.com/alranel/cino/lib"
@@ -206,3 +209,53 @@ func TestGetBoardsFromCore(t *testing.T) {
 		t.Logf("(got %v, expected %v)", result, expected)
 	}
 }
+
+func TestBuildMatrixMonorepo(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "cino-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(repoDir)
+	for lib, architectures := range map[string]string{"A": "avr,samd", "B": "samd"} {
+		testDir := filepath.Join(repoDir, "libraries", lib, "hwtest", "basic")
+		os.MkdirAll(testDir, os.ModePerm)
+		ioutil.WriteFile(filepath.Join(repoDir, "libraries", lib, "library.properties"),
+			[]byte("name="+lib+"\narchitectures="+architectures+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(testDir, "cino.yml"), []byte("require-wiring: ["+lib+"]\n"), 0644)
+	}
+
+	tests, err := FindTests(repoDir)
+	if err != nil {
+		panic(err)
+	}
+	for _, test := range tests {
+		if test.PackageType != Library || filepath.Dir(filepath.Dir(test.Path)) != test.PackagePath {
+			t.Errorf("wrong package for test %s: %s", test.RelPath(), test.PackagePath)
+		}
+	}
+
+	var got []string
+	for _, r := range buildMatrix(tests) {
+		got = append(got, r.Effective.RequireWiring[0]+":"+r.Effective.Sketches[0].RequireArchitecture)
+	}
+	sort.Strings(got)
+	expected := []string{"A:avr", "A:samd", "B:samd"}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestRepeatByProfiles(t *testing.T) {
+	tr := TestRequirements{Sketches: []SketchRequirements{
+		{ProfileFQBNs: []string{"arduino:avr:uno", "arduino:samd:mkr1000"}},
+		{RequireFQBN: "arduino:avr:nano"},
+	}}
+	var got []string
+	for _, r := range RepeatByProfiles(tr) {
+		got = append(got, r.Effective.Sketches[0].RequireFQBN+","+r.Effective.Sketches[1].RequireFQBN)
+	}
+	expected := []string{"arduino:avr:uno,arduino:avr:nano", "arduino:samd:mkr1000,arduino:avr:nano"}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,23 @@
+#include <cino.h>
+
+// This test only exercises logic, so it can also be run on the host with
+// cino-runner run --native.
+
+int clamp(int value, int low, int high)
+{
+    return constrain(value, low, high);
+}
+
+void setup()
+{
+    TEST_PLAN(4);
+    CHECK(clamp(5, 0, 10) == 5);
+    CHECK(clamp(-3, 0, 10) == 0);
+
+    String s = "cino";
+    s += 42;
+    CHECK(s == "cino42");
+    CHECK(s.substring(4).toInt() == 42);
+}
+
+void loop() {}
@@ -101,25 +101,41 @@ func (j *Job) DeviceFQBNs() (out []string) {
 	return funk.UniqString(out)
 }
 
+// StatusFromResults computes the overall job status from the status of its tests.
+// Expected failures count as success, while unexpected passes count as failure.
+// An empty string is returned if no tests were run at all.
 func (j *Job) StatusFromResults() string {
-	status := "skipped"
+	status := ""
 	for _, t := range j.Tests {
-		if status == "skipped" && t.Status == "success" {
-			status = "success"
-		} else if t.Status == "failure" {
+		switch t.Status {
+		case "skipped":
+			if status == "" {
+				status = "skipped"
+			}
+		case "success", "xfail":
+			if status == "" || status == "skipped" {
+				status = "success"
+			}
+		case "failure", "xpass":
 			status = "failure"
 		}
 	}
 	return status
 }
 
-func (j *Job) Report() (out string) {
+// Report returns the output of all the tests in this job. Unless full is true,
+// log messages and serial output coming from the boards are left out.
+func (j *Job) Report(full bool) (out string) {
 	if j.Tests == nil {
 		return ""
 	}
 	for _, t := range j.Tests {
 		out += fmt.Sprintf("Running test in %s:\n", t.RelPath())
-		out += t.Output
+		if full {
+			out += t.Log
+		} else {
+			out += t.Output
+		}
 		out += "\n"
 	}
 	return out
@@ -0,0 +1,61 @@
+package lib
+
+import "testing"
+
+func TestStatusFromResults(t *testing.T) {
+	tests := []struct {
+		statuses []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"success"}, "success"},
+		{[]string{"failure"}, "failure"},
+		{[]string{"skipped"}, "skipped"},
+		{[]string{"skipped", "skipped"}, "skipped"},
+		{[]string{"skipped", "success"}, "success"},
+		{[]string{"success", "skipped"}, "success"},
+		{[]string{"xfail"}, "success"},
+		{[]string{"skipped", "xfail"}, "success"},
+		{[]string{"xpass"}, "failure"},
+		{[]string{"xpass", "success"}, "failure"},
+		{[]string{"success", "failure", "skipped"}, "failure"},
+		{[]string{"failure", "success"}, "failure"},
+	}
+	for _, tt := range tests {
+		var job Job
+		for _, s := range tt.statuses {
+			job.Tests = append(job.Tests, Test{Status: s})
+		}
+		if got := job.StatusFromResults(); got != tt.expected {
+			t.Errorf("%v: got %q, expected %q", tt.statuses, got, tt.expected)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	job := Job{Tests: []Test{
+		{
+			Path: "/repo/test/a", RepoPath: "/repo",
+			Output: "PASS: a.ino:1: x\n",
+			Log:    "SERIAL: secret\nPASS: a.ino:1: x\n",
+		},
+		{
+			Path: "/repo/test/b", RepoPath: "/repo",
+			Output: "FAIL: b.ino:2: y\n",
+			Log:    "LOG: private\nFAIL: b.ino:2: y\n",
+		},
+	}}
+	public := "Running test in test/a:\nPASS: a.ino:1: x\n\nRunning test in test/b:\nFAIL: b.ino:2: y\n\n"
+	if got := job.Report(false); got != public {
+		t.Errorf("got public report %q, expected %q", got, public)
+	}
+	full := "Running test in test/a:\nSERIAL: secret\nPASS: a.ino:1: x\n\nRunning test in test/b:\nLOG: private\nFAIL: b.ino:2: y\n\n"
+	if got := job.Report(true); got != full {
+		t.Errorf("got full report %q, expected %q", got, full)
+	}
+
+	var empty Job
+	if empty.Report(true) != "" {
+		t.Errorf("report of job without tests is not empty")
+	}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SketchProfile is a build profile defined in the sketch.yaml file of a
+// sketch, pinning the versions of the platforms and libraries to be used.
+type SketchProfile struct {
+	FQBN      string
+	Platforms []struct {
+		Platform         string // such as "arduino:avr (1.8.3)"
+		PlatformIndexURL string `yaml:"platform_index_url"`
+	}
+	Libraries []string // such as "Servo (1.1.8)"
+}
+
+// LoadSketchProfiles returns the profiles defined in the sketch.yaml file
+// of the sketch in dir, if any.
+func LoadSketchProfiles(dir string) (map[string]SketchProfile, error) {
+	var sketchYAML struct {
+		Profiles map[string]SketchProfile
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sketch.yaml"))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(filepath.Join(dir, "sketch.yml"))
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &sketchYAML); err != nil {
+		return nil, fmt.Errorf("error parsing sketch.yaml: %w", err)
+	}
+	return sketchYAML.Profiles, nil
+}
+
+// Versions returns the versions of the platforms and libraries pinned by the
+// profile, by core ID or library name.
+func (p *SketchProfile) Versions() map[string]string {
+	out := make(map[string]string)
+	for _, platform := range p.Platforms {
+		name, version := splitProfileVersion(platform.Platform)
+		out[name] = version
+	}
+	for _, lib := range p.Libraries {
+		name, version := splitProfileVersion(lib)
+		out[name] = version
+	}
+	return out
+}
+
+// splitProfileVersion splits a "name (version)" entry of sketch.yaml.
+func splitProfileVersion(s string) (name, version string) {
+	if i := strings.Index(s, "("); i != -1 {
+		return strings.TrimSpace(s[:i]), strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s[i+1:]), ")"))
+	}
+	return strings.TrimSpace(s), ""
+}
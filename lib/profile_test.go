@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSketchProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Sketches without sketch.yaml have no profiles
+	if profiles, err := LoadSketchProfiles(dir); err != nil || profiles != nil {
+		t.Errorf("got %v, %v without sketch.yaml", profiles, err)
+	}
+
+	// The sketch.yml name is accepted too
+	ioutil.WriteFile(filepath.Join(dir, "sketch.yml"), []byte(`profiles:
+  uno:
+    fqbn: arduino:avr:uno
+    platforms:
+      - platform: arduino:avr (1.8.3)
+    libraries:
+      - Servo (1.1.8)
+      - ArduinoJson
+  pico:
+    fqbn: rp2040:rp2040:rpipico
+    platforms:
+      - platform: rp2040:rp2040 (2.3.1)
+        platform_index_url: https://github.com/earlephilhower/arduino-pico/releases/download/global/package_rp2040_index.json
+`), 0644)
+	profiles, err := LoadSketchProfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles["uno"].FQBN != "arduino:avr:uno" || profiles["pico"].FQBN != "rp2040:rp2040:rpipico" {
+		t.Fatalf("wrong profiles %+v", profiles)
+	}
+	if u := profiles["pico"].Platforms[0].PlatformIndexURL; u == "" {
+		t.Errorf("platform_index_url not parsed")
+	}
+	uno := profiles["uno"]
+	expected := map[string]string{"arduino:avr": "1.8.3", "Servo": "1.1.8", "ArduinoJson": ""}
+	if versions := uno.Versions(); !reflect.DeepEqual(versions, expected) {
+		t.Errorf("got versions %v, expected %v", versions, expected)
+	}
+
+	// sketch.yaml takes precedence
+	ioutil.WriteFile(filepath.Join(dir, "sketch.yaml"), []byte("profiles:\n  nano:\n    fqbn: arduino:avr:nano\n"), 0644)
+	if profiles, err := LoadSketchProfiles(dir); err != nil || len(profiles) != 1 || profiles["nano"].FQBN != "arduino:avr:nano" {
+		t.Errorf("got %v, %v with sketch.yaml", profiles, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "sketch.yaml"), []byte("profiles: [\n"), 0644)
+	if _, err := LoadSketchProfiles(dir); err == nil {
+		t.Errorf("expected error for invalid sketch.yaml")
+	}
+}
+
+func TestSplitProfileVersion(t *testing.T) {
+	tests := []struct {
+		entry, name, version string
+	}{
+		{"arduino:avr (1.8.3)", "arduino:avr", "1.8.3"},
+		{"Adafruit NeoPixel (1.10.4)", "Adafruit NeoPixel", "1.10.4"},
+		{"  Servo  ( 1.1.8 ) ", "Servo", "1.1.8"},
+		{"ArduinoJson", "ArduinoJson", ""},
+		{"Servo()", "Servo", ""},
+	}
+	for _, tt := range tests {
+		if name, version := splitProfileVersion(tt.entry); name != tt.name || version != tt.version {
+			t.Errorf("%q: got %q, %q", tt.entry, name, version)
+		}
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+
+	"gopkg.in/ini.v1"
 )
 
 // FindTests looks for all the cino.yml files under the given path,
-// detects the type of package contains them and returns a slice of
-// Test objects.
+// detects the type of package containing each of them and returns a slice
+// of Test objects.
 func FindTests(path string) ([]Test, error) {
 	var tests []Test
 
@@ -23,7 +26,7 @@ func FindTests(path string) ([]Test, error) {
 	// Do we have a cino.yml file?
 	if _, err := os.Stat(filepath.Join(path, "cino.yml")); !os.IsNotExist(err) {
 		// If we have a cino.yml file, path is a single test or a sketch
-		test, err := NewTest(path, path, Sketch)
+		test, err := NewTest(path, path, path, Sketch)
 		if err != nil {
 			return nil, err
 		}
@@ -51,16 +54,11 @@ func FindTests(path string) ([]Test, error) {
 			return nil, fmt.Errorf("No tests were found in %s", path)
 		}
 
-		// let's check if this is a library or a core
-		cType := Sketch
-		if IsLibrary(path) {
-			cType = Library
-		} else if IsCore(path) {
-			cType = Core
-		}
-
 		for _, subpath := range testsInSubdirectories {
-			test, err := NewTest(subpath, path, cType)
+			// Find the library or core containing the test, if any, as a
+			// repository may contain more than one.
+			packagePath, packageType := FindPackage(subpath, path)
+			test, err := NewTest(subpath, path, packagePath, packageType)
 			if err != nil {
 				return nil, err
 			}
@@ -71,9 +69,33 @@ func FindTests(path string) ([]Test, error) {
 	return tests, nil
 }
 
+// FindPackage walks up from dir to root looking for the nearest library or
+// core. If none is found, root is returned as a sketch package.
+func FindPackage(dir, root string) (string, PackageType) {
+	for {
+		if IsLibrary(dir) {
+			return dir, Library
+		} else if IsCore(dir) {
+			return dir, Core
+		}
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir || !strings.HasPrefix(parent, root) {
+			break
+		}
+		dir = parent
+	}
+	return root, Sketch
+}
+
+// IsLibrary returns true if path contains an Arduino library, or a PlatformIO
+// library only having a library.json manifest.
 func IsLibrary(path string) bool {
-	_, err := os.Stat(filepath.Join(path, "library.properties"))
-	return !os.IsNotExist(err)
+	for _, manifest := range []string{"library.properties", "library.json"} {
+		if _, err := os.Stat(filepath.Join(path, manifest)); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
 }
 
 func IsCore(path string) bool {
@@ -81,6 +103,112 @@ func IsCore(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// LibraryArchitectures returns the architectures declared in the
+// library.properties file of the library in dir. Libraries only having a
+// library.json manifest are assumed to support all architectures, as it
+// declares PlatformIO platforms instead.
+func LibraryArchitectures(dir string) ([]string, error) {
+	f, err := ini.Load(filepath.Join(dir, "library.properties"))
+	if os.IsNotExist(err) && IsLibrary(dir) {
+		return []string{"*"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, a := range strings.Split(f.Section("").Key("architectures").String(), ",") {
+		out = append(out, strings.TrimSpace(a))
+	}
+	return out, nil
+}
+
+// CoreBoards returns the IDs of the boards declared in the boards.txt file of
+// the core in dir.
+func CoreBoards(dir string) ([]string, error) {
+	f, err := ini.Load(filepath.Join(dir, "boards.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	re := regexp.MustCompile(`^([^.]+)\.name$`)
+	for _, k := range f.Section("").KeyStrings() {
+		res := re.FindStringSubmatch(k)
+		if len(res) == 2 {
+			out = append(out, res[1])
+		}
+	}
+	return out, nil
+}
+
+// IsPlatformIOProject returns true if dir contains a PlatformIO project.
+func IsPlatformIOProject(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "platformio.ini"))
+	return !os.IsNotExist(err)
+}
+
+// PlatformIOEnvs returns the names of the environments declared in the
+// platformio.ini file in dir.
+func PlatformIOEnvs(dir string) ([]string, error) {
+	f, err := ini.LoadSources(ini.LoadOptions{AllowPythonMultilineValues: true},
+		filepath.Join(dir, "platformio.ini"))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, name := range f.SectionStrings() {
+		if strings.HasPrefix(name, "env:") {
+			out = append(out, strings.TrimPrefix(name, "env:"))
+		}
+	}
+	return out, nil
+}
+
+var (
+	cinoIncludeRe = regexp.MustCompile(`(?m)^\s*#\s*include\s*[<"]cino\.h[>"]`)
+	testPlanRe    = regexp.MustCompile(`\bTEST_(NO)?PLAN\s*\(`)
+)
+
+// MainSketchFile returns the path of the main .ino file of the sketch in dir,
+// or an empty string if there is none. It's named after the directory, but
+// the directory name may not match, as with cloned repositories: in this case
+// the only .ino file is used.
+func MainSketchFile(dir string) string {
+	main := filepath.Join(dir, filepath.Base(dir)+".ino")
+	if _, err := os.Stat(main); os.IsNotExist(err) {
+		inos, _ := filepath.Glob(filepath.Join(dir, "*.ino"))
+		if len(inos) != 1 {
+			return ""
+		}
+		main = inos[0]
+	}
+	return main
+}
+
+// IsInSketchTest returns true if dir contains a sketch whose main .ino file
+// includes cino.h but never declares a test plan. This is the case of
+// application sketches having assertions embedded in their code.
+func IsInSketchTest(dir string) bool {
+	main := MainSketchFile(dir)
+	if main == "" {
+		return false
+	}
+	if src, err := ioutil.ReadFile(main); err != nil || !cinoIncludeRe.Match(src) {
+		return false
+	}
+
+	var sources []string
+	for _, pattern := range []string{"*.ino", "*.cpp", "*.h", "src/*.cpp", "src/*.h"} {
+		files, _ := filepath.Glob(filepath.Join(dir, pattern))
+		sources = append(sources, files...)
+	}
+	for _, file := range sources {
+		if src, err := ioutil.ReadFile(file); err == nil && testPlanRe.Match(src) {
+			return false
+		}
+	}
+	return true
+}
+
 func CloneRepo(cloneURL string, commitRef string) (string, error) {
 	repoDir, err := ioutil.TempDir("/tmp", ".cino-server")
 	if err != nil {
@@ -97,8 +225,8 @@ func CloneRepo(cloneURL string, commitRef string) (string, error) {
 		cmd := exec.Command("git", c...)
 		cmd.Dir = repoDir
 		if out, err := cmd.CombinedOutput(); err != nil {
-			os.Stderr.WriteString(fmt.Sprintf("%s: %s", strings.Join(c, " "), out))
-			return "", err
+			os.RemoveAll(repoDir)
+			return "", fmt.Errorf("git %s: %s\n%s", strings.Join(c, " "), err, strings.TrimSpace(string(out)))
 		}
 	}
 
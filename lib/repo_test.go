@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsInSketchTest(t *testing.T) {
+	const app = "#include <cino.h>\nvoid setup() { CHECK(1 == 1); }\nvoid loop() {}\n"
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected bool
+	}{
+		{"embedded", map[string]string{"app/app.ino": app}, true},
+		{"include with spaces", map[string]string{"app/app.ino": "  # include \"cino.h\"\n"}, true},
+		{"no include", map[string]string{"app/app.ino": "void setup() {}\nvoid loop() {}\n"}, false},
+		{"include in other file", map[string]string{
+			"app/app.ino":    "void setup() {}\nvoid loop() {}\n",
+			"app/helper.ino": app,
+		}, false},
+		{"plan", map[string]string{"app/app.ino": app + "void f() { TEST_PLAN(1); }\n"}, false},
+		{"noplan", map[string]string{"app/app.ino": app + "void f() { TEST_NOPLAN(); }\n"}, false},
+		{"plan in src", map[string]string{
+			"app/app.ino":        app,
+			"app/src/plan.cpp":   "void f() { TEST_PLAN (2); }\n",
+			"app/src/helper.cpp": "",
+		}, false},
+		{"plan in subdirectory", map[string]string{
+			"app/app.ino":           app,
+			"app/extras/other.cpp":  "void f() { TEST_PLAN(2); }\n",
+			"app/extras/other2.ino": "void g() { TEST_NOPLAN(); }\n",
+		}, true},
+		{"name mismatch", map[string]string{"app/main.ino": app}, true},
+		{"name mismatch with many sketches", map[string]string{
+			"app/main.ino":  app,
+			"app/other.ino": "",
+		}, false},
+		{"no sketch", map[string]string{"app/README.md": "#include <cino.h>\n"}, false},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "cino-repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range tt.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := IsInSketchTest(filepath.Join(dir, "app")); got != tt.expected {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestPlatformIOEnvs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := PlatformIOEnvs(dir); err == nil {
+		t.Errorf("expected error for missing platformio.ini")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "platformio.ini"), []byte(`; comment
+[platformio]
+default_envs = uno
+
+[env]
+framework = arduino
+
+[env:uno]
+platform = atmelavr
+board = uno
+lib_deps =
+    Servo
+    Wire
+
+[env:esp32]
+platform = espressif32
+board = esp32dev
+`), 0644)
+	envs, err := PlatformIOEnvs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"uno", "esp32"}; !reflect.DeepEqual(envs, expected) {
+		t.Errorf("got %v, expected %v", envs, expected)
+	}
+	if !IsPlatformIOProject(dir) {
+		t.Errorf("not detected as PlatformIO project")
+	}
+}
+
+func TestLibraryManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cino-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if IsLibrary(dir) {
+		t.Errorf("empty directory detected as library")
+	}
+
+	// PlatformIO libraries may only have library.json
+	ioutil.WriteFile(filepath.Join(dir, "library.json"), []byte(`{"name": "Foo", "platforms": "atmelavr"}`), 0644)
+	if !IsLibrary(dir) {
+		t.Errorf("library.json not detected as library")
+	}
+	if archs, err := LibraryArchitectures(dir); err != nil || !reflect.DeepEqual(archs, []string{"*"}) {
+		t.Errorf("got %v, %v for library.json", archs, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "library.properties"), []byte("name=Foo\narchitectures=avr, samd\n"), 0644)
+	if archs, err := LibraryArchitectures(dir); err != nil || !reflect.DeepEqual(archs, []string{"avr", "samd"}) {
+		t.Errorf("got %v, %v for library.properties", archs, err)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/thoas/go-funk"
 	"gopkg.in/yaml.v2"
 )
 
@@ -27,6 +30,8 @@ type SketchRequirements struct {
 	RequireFQBN         string   `yaml:"require-fqbn"`
 	RequireArchitecture string   `yaml:"require-architecture"`
 	RequireFeatures     []string `yaml:"require-features"`
+	ProfileFQBNs        []string `yaml:"-"` // FQBNs of the sketch.yaml profiles (or PlatformIO envs) to be tested, if any
+	Backend             string   `yaml:"-"` // build backend needed by the sketch; empty for arduino-cli
 }
 
 type TestRequirements struct {
@@ -38,11 +43,31 @@ type TestRequirements struct {
 type TestYML struct {
 	GlobalTestRequirements `yaml:",inline"`
 	Sketches               []testSketch
+	Xfail                  []Xfail
+	Cores                  []string // version pins, such as arduino:avr@1.8.3
+	CoreID                 string   `yaml:"core-id"`         // vendor:arch of the core under test, if it can't be detected
+	AdditionalURLs         []string `yaml:"additional-urls"` // third-party package indexes
+	Duration               string   // how long in-sketch tests are run for, such as 30s
+}
+
+// Xfail declares a board (or a whole architecture) for which the test is
+// known to fail.
+type Xfail struct {
+	FQBN         string
+	Architecture string
+	Reason       string
 }
 
 type testSketch struct {
-	Dir       string
-	Libraries []string
+	Dir             string
+	Libraries       []string // names, optionally followed by a version, such as Servo@1.1.8
+	Protocol        string   // json (default) or compact
+	Framework       string   // cino (default), aunit, arduinounit or unity
+	BaudRate        int      `yaml:"baud-rate"`
+	SerialConfig    string   `yaml:"serial-config"` // such as 8N1
+	Profiles        []string // names of the sketch.yaml profiles (or PlatformIO envs) to be tested
+	Defines         []string // preprocessor symbols, such as LED_PIN=13
+	BuildProperties []string `yaml:"build-properties"` // such as build.f_cpu=8000000L
 	SketchRequirements
 }
 
@@ -50,17 +75,31 @@ type testSketch struct {
 type Test struct {
 	TestYML
 	Path        string // absolute path to the test directory
+	RepoPath    string // absolute path to the repository (or directory) containing the test
 	PackagePath string // absolute path to the package containing the test (if any)
 	PackageType PackageType
-	Status      string // success, failure, skipped
-	Output      string
+	Status      string // success, failure, skipped, xfail, xpass
+	Output      string // public output, safe to be shown in reports
+	Log         string // full log, including messages and serial output from the boards
 	DeviceFQBNs []string
+	InSketch    bool              // assertions are embedded in an application sketch, with no test plan
+	Locked      map[string]string // versions read from cino.lock, by core ID or library name
+	Versions    map[string]string // versions of the cores and libraries actually used
 }
 
+// BackendPlatformIO is the build backend used for sketches contained in
+// PlatformIO projects. Devices using it have an environment name as FQBN.
+const BackendPlatformIO = "platformio"
+
+// LockFile is the name of the file recording the versions of the cores and
+// libraries used by a test, for reproducing it later.
+const LockFile = "cino.lock"
+
 // NewTest instantiates a new Test object.
-func NewTest(path, packagePath string, packageType PackageType) (*Test, error) {
+func NewTest(path, repoPath, packagePath string, packageType PackageType) (*Test, error) {
 	test := &Test{
 		Path:        path,
+		RepoPath:    repoPath,
 		PackagePath: packagePath,
 		PackageType: packageType,
 	}
@@ -77,11 +116,86 @@ func NewTest(path, packagePath string, packageType PackageType) (*Test, error) {
 		}
 	}
 
+	for _, s := range test.Sketches {
+		if s.Protocol != "" && s.Protocol != "json" && s.Protocol != "compact" {
+			return nil, fmt.Errorf("Invalid protocol in cino.yml: %s\n", s.Protocol)
+		}
+		if s.Framework != "" && !funk.ContainsString([]string{"cino", "aunit", "arduinounit", "unity"}, s.Framework) {
+			return nil, fmt.Errorf("Invalid framework in cino.yml: %s\n", s.Framework)
+		}
+	}
+	for _, c := range test.Cores {
+		if id, version := SplitVersion(c); strings.Count(id, ":") != 1 || version == "" {
+			return nil, fmt.Errorf("Invalid core in cino.yml (expected vendor:arch@version): %s\n", c)
+		}
+	}
+
+	if test.Duration != "" {
+		if _, err := time.ParseDuration(test.Duration); err != nil {
+			return nil, fmt.Errorf("Invalid duration in cino.yml: %s\n", test.Duration)
+		}
+	}
+	if test.CoreID != "" && strings.Count(test.CoreID, ":") != 1 {
+		return nil, fmt.Errorf("Invalid core-id in cino.yml (expected vendor:arch): %s\n", test.CoreID)
+	}
+
+	// Parse the cino.lock file, if any.
+	if lockFile, err := ioutil.ReadFile(filepath.Join(test.Path, LockFile)); err == nil {
+		if err := yaml.Unmarshal(lockFile, &test.Locked); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", LockFile, err)
+		}
+	}
+
 	// If cino.yml defines no sketches, create a default one.
 	if len(test.Sketches) == 0 {
 		test.Sketches = append(test.Sketches, testSketch{Dir: "."})
 	} else if len(test.Sketches) == 1 {
 		test.Sketches[0].Dir = "."
+	}
+	// Determine the FQBNs that each sketch is built for: the environments of
+	// PlatformIO projects, or the sketch.yaml profiles listed in cino.yml,
+	// checking that they exist.
+	for i, s := range test.Sketches {
+		if IsPlatformIOProject(filepath.Join(test.Path, s.Dir)) {
+			// PlatformIO projects are tested on all of their environments,
+			// unless only some are listed
+			envs, err := PlatformIOEnvs(filepath.Join(test.Path, s.Dir))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing platformio.ini: %w", err)
+			}
+			for _, name := range s.Profiles {
+				if !funk.ContainsString(envs, name) {
+					return nil, fmt.Errorf("Environment referenced in cino.yml does not exist in platformio.ini: %s\n", name)
+				}
+			}
+			if len(s.Profiles) > 0 {
+				envs = s.Profiles
+			}
+			test.Sketches[i].Backend = BackendPlatformIO
+			test.Sketches[i].ProfileFQBNs = envs
+			continue
+		}
+		if len(s.Profiles) == 0 {
+			continue
+		}
+		if len(s.Libraries) > 0 {
+			return nil, fmt.Errorf("Libraries cannot be listed in cino.yml for sketches using profiles\n")
+		}
+		profiles, err := LoadSketchProfiles(filepath.Join(test.Path, s.Dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range s.Profiles {
+			p, ok := profiles[name]
+			if !ok {
+				return nil, fmt.Errorf("Profile referenced in cino.yml does not exist in sketch.yaml: %s\n", name)
+			}
+			test.Sketches[i].ProfileFQBNs = append(test.Sketches[i].ProfileFQBNs, p.FQBN)
+		}
+	}
+
+	if len(test.Sketches) == 1 {
+		test.InSketch = IsInSketchTest(test.Path)
 	} else {
 		// Check that all referenced sketches exist
 		for _, s := range test.Sketches {
@@ -99,10 +213,118 @@ func NewTest(path, packagePath string, packageType PackageType) (*Test, error) {
 
 // RelPath returns the test path relative to the repository root.
 func (test *Test) RelPath() string {
-	path, _ := filepath.Rel(test.PackagePath, test.Path)
+	path, _ := filepath.Rel(test.RepoPath, test.Path)
 	return path
 }
 
+// BoardFQBN strips the board options, if any, from the given FQBN.
+func BoardFQBN(fqbn string) string {
+	if t := strings.SplitN(fqbn, ":", 4); len(t) == 4 {
+		return strings.Join(t[:3], ":")
+	}
+	return fqbn
+}
+
+// SplitVersion splits a core or library specification such as Servo@1.1.8
+// into its name and version. The version is empty if not specified.
+func SplitVersion(spec string) (name, version string) {
+	if i := strings.LastIndex(spec, "@"); i != -1 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// PinnedVersion returns the version to use for the given core ID or library
+// name, as pinned in cino.yml or recorded in cino.lock. It returns an empty
+// string if any version can be used.
+func (test *Test) PinnedVersion(name string) string {
+	for _, c := range test.Cores {
+		if id, version := SplitVersion(c); id == name {
+			return version
+		}
+	}
+	for _, s := range test.Sketches {
+		for _, l := range s.Libraries {
+			if lib, version := SplitVersion(l); lib == name && version != "" {
+				return version
+			}
+		}
+	}
+	return test.Locked[name]
+}
+
+// WriteLock writes the versions used in the last run to the cino.lock file.
+func (test *Test) WriteLock() error {
+	data, err := yaml.Marshal(test.Versions)
+	if err != nil {
+		return err
+	}
+	header := "# Versions of the cores and libraries used by this test, written by cino-runner.\n"
+	return ioutil.WriteFile(filepath.Join(test.Path, LockFile), append([]byte(header), data...), 0644)
+}
+
+// Supports returns false if the given requirements cannot be satisfied by
+// the package containing the test, such as when they require an architecture
+// that the library under test does not support. Only the requirements not
+// declared by the test itself are checked.
+func (test *Test) Supports(tr TestRequirements) bool {
+	for i, s := range tr.Sketches {
+		if i >= len(test.Sketches) {
+			break
+		}
+		switch test.PackageType {
+		case Library:
+			if test.Sketches[i].RequireArchitecture != "" || s.RequireArchitecture == "" || s.RequireArchitecture == "*" {
+				continue
+			}
+			architectures, err := LibraryArchitectures(test.PackagePath)
+			if err == nil && !funk.ContainsString(architectures, "*") && !funk.ContainsString(architectures, s.RequireArchitecture) {
+				return false
+			}
+		case Core:
+			if test.Sketches[i].RequireFQBN != "" || s.RequireFQBN == "" || s.RequireFQBN == "*" {
+				continue
+			}
+			board := s.RequireFQBN
+			if t := strings.Split(s.RequireFQBN, ":"); len(t) >= 3 {
+				if test.CoreID != "" && t[0]+":"+t[1] != test.CoreID {
+					return false
+				}
+				board = t[2]
+			}
+			boards, err := CoreBoards(test.PackagePath)
+			if err == nil && !funk.ContainsString(boards, board) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RunDuration returns how long an in-sketch test is run for.
+func (test *Test) RunDuration() time.Duration {
+	if d, err := time.ParseDuration(test.Duration); err == nil {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// ExpectedFailure returns the xfail entry matching any of the given FQBNs, if any.
+// An xfail FQBN without board options matches the board with any options.
+func (test *Test) ExpectedFailure(fqbns []string) *Xfail {
+	for i, x := range test.Xfail {
+		for _, fqbn := range fqbns {
+			if x.FQBN != "" && (x.FQBN == fqbn || x.FQBN == BoardFQBN(fqbn)) {
+				return &test.Xfail[i]
+			}
+			if t := strings.SplitN(fqbn, ":", 3); x.Architecture != "" && len(t) > 1 && x.Architecture == t[1] {
+				return &test.Xfail[i]
+			}
+		}
+	}
+	return nil
+}
+
 func (test *Test) GetRequirements() TestRequirements {
 	tr := TestRequirements{GlobalTestRequirements: test.GlobalTestRequirements}
 	for _, s := range test.Sketches {
@@ -118,6 +340,8 @@ func (tr *TestRequirements) Clone() (out TestRequirements) {
 		s2.RequireArchitecture = s.RequireArchitecture
 		s2.RequireFQBN = s.RequireFQBN
 		s2.RequireFeatures = append(s2.RequireFeatures, s.RequireFeatures...)
+		s2.ProfileFQBNs = append(s2.ProfileFQBNs, s.ProfileFQBNs...)
+		s2.Backend = s.Backend
 		out.Sketches = append(out.Sketches, s2)
 	}
 	return out